@@ -6,7 +6,7 @@ import (
 	"sync"
 	"time"
 	"encoding/json"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"github.com/op/go-logging"
@@ -14,9 +14,9 @@ import (
 	"path/filepath"
 	"github.com/karlseguin/ccache"
 	"path"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"s3proxy/context"
 	"golang.org/x/net/context"
+	"sync/atomic"
 )
 
 var log = logging.MustGetLogger("s3proxy")
@@ -24,240 +24,813 @@ var log = logging.MustGetLogger("s3proxy")
 type BlobCache interface {
 	Get(context.Context, string) (*faulting.FaultingReader, error)
 	GetMeta(string) *source.Meta
+	Stat(context.Context, string) (*source.Meta, error)
 	Delete(context.Context, string)
-	Directory(string) ([]string, error)
+	Directory(context.Context, string) ([]source.DirEntry, error)
+	List(context.Context, string, *source.ListOptions) (*source.ObjectListing, error)
+	Buckets() ([]source.BucketInfo, error)
+	Put(context.Context, string, io.Reader, *source.Meta, *source.UploadOptions) (*source.Meta, error)
+	CreateMultipartUpload(context.Context, string, *source.Meta, *source.UploadOptions) (string, error)
+	UploadPart(context.Context, string, string, int64, io.Reader, *source.UploadOptions) (string, error)
+	CompleteMultipartUpload(context.Context, string, string, []source.CompletedPart, *source.UploadOptions) (*source.Meta, error)
+	AbortMultipartUpload(context.Context, string, string) error
 }
 
 type S3Cache struct {
 	sync.RWMutex
 	source      source.UpstreamSource
 	cachedFiles map[string]*cacheEntryWrapper
+	cachedMetas map[string]*source.Meta
+	misses      map[string]*miss
+	metaLock    sync.Mutex
 	cacheDir    string
 	ttl         int
 	blockCache  *ccache.LayeredCache
+
+	index       *metaIndex
+
+	staleGrace  time.Duration
+	offline     bool
+
+	revalidateWindow time.Duration
+
+	negativeTTL    time.Duration
+	cacheForbidden bool
+	missSweepAt    int
+
+	listings    map[string]*cachedListing
+	listingLock sync.Mutex
+	listingTTL  time.Duration
+
+	policies    *PolicyTable
+	policyLock  sync.RWMutex
+
+	maxDiskBytes   int64
+	maxDiskPercent int
+	evicting       int32
 }
 
 type cacheEntry struct {
 	key          string
 	meta         *source.Meta
 	faultingFile *faulting.FaultingFile
+	lastAccess   int64
+
+	// Only kept while it is being read, for objects which mustn't be cached
+	transient    bool
+}
+
+func (this *cacheEntry) touch() {
+	atomic.StoreInt64(&this.lastAccess, time.Now().UnixNano())
 }
 
 type cacheEntryWrapper struct {
 	sync.RWMutex
 	entry *cacheEntry
+
+	// Set while the entry is being revalidated in the background
+	revalidating int32
 }
 
 func NewS3Cache(cache *ccache.LayeredCache, s source.UpstreamSource, cacheDir string, ttl int) *S3Cache {
 	c := make(map[string]*cacheEntryWrapper)
 
+	index, err := openIndex(cacheDir)
+	if err != nil {
+		log.Errorf("Unable to open the index in %s, the cache won't survive a restart - %s", cacheDir, err)
+	}
+
 	return &S3Cache{
 		source: s,
 		cachedFiles: c,
+		cachedMetas: make(map[string]*source.Meta),
+		misses: make(map[string]*miss),
 		cacheDir: cacheDir,
 		ttl: ttl,
 		blockCache: cache,
+		index: index,
+		staleGrace: STALE_GRACE,
+		revalidateWindow: REVALIDATE_WINDOW,
+		negativeTTL: NEGATIVE_TTL,
+		listings: make(map[string]*cachedListing),
+		listingTTL: LISTING_TTL,
 	}
 }
 
 func (this *S3Cache) Get(ctx context.Context, uri string) (*faulting.FaultingReader, error) {
-	this.validateEntry(ctx, uri)
+	err := this.validateEntry(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
 
 	ctxValue := ctx.Value(0).(*cache_context.Context)
+	request := requestControl(ctxValue)
+
+	// Only this key is locked while going upstream. Concurrent misses for the
+	// same key wait here and are then served by the single upstream request.
+	wrapper := this.getOrCreateWrapper(uri)
+
+	// Readers are created while holding the entry's lock so that it can't be
+	// evicted from underneath them.
+	wrapper.RLock()
+	if wrapper.entry != nil {
+		if err := this.unservable(wrapper.entry, request); err != nil {
+			wrapper.RUnlock()
+			return nil, err
+		}
 
-	this.RLock()
-	if wrapper, ok := this.cachedFiles[uri]; ok && wrapper.entry != nil {
 		log.Debugf("[%d] Cache hit: %s", ctxValue.Sequence, uri)
-		this.RUnlock()
-		return faulting.NewFaultingReader(ctx, wrapper.entry.faultingFile), nil
+		wrapper.entry.touch()
+		r := faulting.NewFaultingReader(ctx, wrapper.entry.faultingFile)
+		wrapper.RUnlock()
+		return r, nil
 	}
-	this.RUnlock()
+	wrapper.RUnlock()
 
-	this.Lock()
-	defer this.Unlock()
+	// A request for no-cache looks for itself
+	if err := this.cachedMiss(uri); err != nil && !request.noCache {
+		log.Debugf("[%d] Cached miss: %s", ctxValue.Sequence, uri)
+		return nil, err
+	}
+
+	wrapper.Lock()
 
 	// Once we have the lock, make sure someone else didn't already do this
 	// while we were waiting.
-	if wrapper, ok := this.cachedFiles[uri]; ok && wrapper.entry != nil {
+	if wrapper.entry != nil {
+		if err := this.unservable(wrapper.entry, request); err != nil {
+			wrapper.Unlock()
+			return nil, err
+		}
+
 		log.Debugf("[%d] Cache hit: %s", ctxValue.Sequence, uri)
-		return faulting.NewFaultingReader(ctx, wrapper.entry.faultingFile), nil
+		wrapper.entry.touch()
+		r := faulting.NewFaultingReader(ctx, wrapper.entry.faultingFile)
+		wrapper.Unlock()
+		return r, nil
+	}
+
+	// Nor that it turned out to be missing
+	if err := this.cachedMiss(uri); err != nil && !request.noCache {
+		wrapper.Unlock()
+		log.Debugf("[%d] Cached miss: %s", ctxValue.Sequence, uri)
+		return nil, err
+	}
+
+	if this.offline {
+		wrapper.Unlock()
+		log.Infof("[%d] Offline, unable to fetch %s", ctxValue.Sequence, uri)
+		return nil, ErrOffline
+	}
+
+	if request.onlyIfCached {
+		wrapper.Unlock()
+		log.Debugf("[%d] Not cached, not fetching %s", ctxValue.Sequence, uri)
+		return nil, ErrNotCached
 	}
 
 	log.Debugf("[%d] Cache miss: %s", ctxValue.Sequence, uri)
 	faultingFile, meta, err := this.source.Get(ctx, uri)
 	if err != nil {
+		this.recordMiss(uri, err)
+		wrapper.Unlock()
 		return nil, err
 	}
 
-	// Set the TTL
-	meta.Expires = time.Now().Add(time.Duration(this.ttl) * time.Second)
-
-	err = writeMeta(meta, faultingFile.Dst)
-	if err != nil {
-		log.Errorf("[%d] ERROR saving meta: %s", ctxValue.Sequence, err)
+	policy := this.objectPolicy(uri, meta)
+	if policy.NoMemory {
+		faultingFile.DisableMemoryCache()
 	}
 
+	// Set the TTL
+	meta.Validated = time.Now()
+	meta.Expires = meta.Validated.Add(policy.TTL)
+	meta.Key = uri
+
 	entry := &cacheEntry{
 		key: uri,
 		meta: meta,
 		faultingFile: faultingFile,
+		transient: policy.NoCache || request.noStore || (policy.MaxSize > 0 && meta.Size > policy.MaxSize),
+	}
+	entry.touch()
+	wrapper.entry = entry
+	r := faulting.NewFaultingReader(ctx, faultingFile)
+	wrapper.Unlock()
+
+	if entry.transient {
+		log.Debugf("[%d] Not caching %s", ctxValue.Sequence, uri)
+		go this.dropWhenUnused(wrapper, entry)
+		return r, nil
 	}
 
-	if wrapper, ok := this.cachedFiles[uri]; ok {
-		wrapper.entry = entry
-	} else {
-		this.cachedFiles[uri] = &cacheEntryWrapper{
-			entry: entry,
-		}
+	// The meta is saved as the download progresses. This needs the entry's
+	// lock, so must happen once it has been released.
+	faultingFile.SetCheckpoint(this.checkpointer(wrapper, faultingFile))
+
+	// The full entry supersedes any meta or miss cached on its own
+	this.metaLock.Lock()
+	delete(this.cachedMetas, uri)
+	delete(this.misses, uri)
+	this.metaLock.Unlock()
+
+	// Make room for the new object in the background
+	go this.EnforceDiskLimit()
+
+	return r, nil
+}
+
+// getWrapper returns the wrapper for a key, or nil if the key has never been
+// cached. The cache's own lock only guards the map; each wrapper's lock
+// guards its entry. The two are never held at the same time.
+func (this *S3Cache) getWrapper(uri string) *cacheEntryWrapper {
+	this.RLock()
+	defer this.RUnlock()
+	return this.cachedFiles[uri]
+}
+
+func (this *S3Cache) getOrCreateWrapper(uri string) *cacheEntryWrapper {
+	if wrapper := this.getWrapper(uri); wrapper != nil {
+		return wrapper
 	}
 
-	return faulting.NewFaultingReader(ctx, faultingFile), nil
+	this.Lock()
+	defer this.Unlock()
+
+	wrapper, ok := this.cachedFiles[uri]
+	if !ok {
+		wrapper = &cacheEntryWrapper{}
+		this.cachedFiles[uri] = wrapper
+	}
+	return wrapper
 }
 
-func (this *S3Cache) GetMeta(uri string) *source.Meta {
+// wrappers returns a snapshot of all the wrappers in the cache.
+func (this *S3Cache) wrappers() []*cacheEntryWrapper {
 	this.RLock()
 	defer this.RUnlock()
-	if wrapper, ok := this.cachedFiles[uri]; ok && wrapper.entry != nil {
+
+	wrappers := make([]*cacheEntryWrapper, 0, len(this.cachedFiles))
+	for _, wrapper := range this.cachedFiles {
+		wrappers = append(wrappers, wrapper)
+	}
+	return wrappers
+}
+
+func (this *S3Cache) GetMeta(uri string) *source.Meta {
+	wrapper := this.getWrapper(uri)
+	if wrapper == nil {
+		return nil
+	}
+
+	wrapper.RLock()
+	defer wrapper.RUnlock()
+	if wrapper.entry != nil {
 		return wrapper.entry.meta
 	}
 	return nil
 }
 
+// Stat returns the meta for an object without downloading its content. If the
+// object is not cached, its upstream meta is fetched and cached on its own.
+func (this *S3Cache) Stat(ctx context.Context, uri string) (*source.Meta, error) {
+	err := this.validateEntry(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+
+	request := requestControl(ctxValue)
+
+	if meta := this.GetMeta(uri); meta != nil {
+		log.Debugf("[%d] Cache hit (meta): %s", ctxValue.Sequence, uri)
+		return meta, nil
+	}
+
+	this.metaLock.Lock()
+	cached, ok := this.cachedMetas[uri]
+	this.metaLock.Unlock()
+
+	if ok && !request.forcesRevalidation(cached) {
+		if cached.Expires.After(time.Now()) {
+			log.Debugf("[%d] Meta cache hit: %s", ctxValue.Sequence, uri)
+			return cached, nil
+		}
+		if request.acceptsStale(cached) {
+			log.Debugf("[%d] Meta cache hit, stale: %s", ctxValue.Sequence, uri)
+			ctxValue.Stale = true
+			return cached, nil
+		}
+	}
+
+	if ok && request.onlyIfCached {
+		ctxValue.Stale = !cached.Expires.After(time.Now())
+		return cached, nil
+	}
+
+	if err := this.cachedMiss(uri); err != nil && !request.noCache {
+		log.Debugf("[%d] Cached miss: %s", ctxValue.Sequence, uri)
+		return nil, err
+	}
+
+	if this.offline {
+		if ok {
+			ctxValue.Stale = true
+			return cached, nil
+		}
+		return nil, ErrOffline
+	}
+
+	if request.onlyIfCached {
+		return nil, ErrNotCached
+	}
+
+	log.Debugf("[%d] Meta cache miss: %s", ctxValue.Sequence, uri)
+	meta, err := this.source.GetMeta(uri)
+	if err != nil {
+		if ok && !isNotFound(err) && this.withinGrace(cached.Expires) && !this.objectPolicy(uri, cached).MustRevalidate {
+			log.Infof("[%d] Unable to revalidate meta for %s, serving stale: %s", ctxValue.Sequence, uri, err)
+			ctxValue.Stale = true
+			return cached, nil
+		}
+		this.recordMiss(uri, err)
+		return nil, err
+	}
+
+	meta.Validated = time.Now()
+	policy := this.objectPolicy(uri, meta)
+	if policy.NoCache || request.noStore {
+		return meta, nil
+	}
+	meta.Expires = meta.Validated.Add(policy.TTL)
+
+	this.metaLock.Lock()
+	this.cachedMetas[uri] = meta
+	delete(this.misses, uri)
+	this.metaLock.Unlock()
+
+	return meta, nil
+}
+
+// Close releases the index, so that the cache directory can be opened again.
+// The cache mustn't be used afterwards.
+func (this *S3Cache) Close() error {
+	return this.index.close()
+}
+
+// RecoverMeta adds the objects left on disk by a previous run, as recorded in
+// the index. Complete objects are served as they are, partial ones have their
+// missing blocks fetched on demand and anything else is discarded.
 func (this *S3Cache) RecoverMeta() {
+	if !this.index.imported() {
+		this.importMetaFiles()
+	}
+
+	// Uploads which were under way can't be resumed
+	os.RemoveAll(path.Join(this.cacheDir, UPLOADS_DIR))
+
+	metas, err := this.index.all()
+	if err != nil {
+		log.Errorf("Unable to read the cache index - %s", err)
+		return
+	}
+
+	for _, m := range metas {
+		if !recoverable(m, source.CachePath(this.cacheDir, m.Key)) {
+			log.Infof("Discarding incomplete object %s", m.Key)
+			this.discard(m.Key)
+			continue
+		}
+
+		log.Debugf("Adding meta %s", m.Key)
+		log.Debugf("    %+v", m)
+		this.AddMeta(m, m.Key)
+	}
+}
+
+// importMetaFiles moves the '._meta_' files, which older versions kept next to
+// each object, into the index. This only ever happens once per cache
+// directory.
+func (this *S3Cache) importMetaFiles() {
+	log.Info("Importing meta files into the index")
+
+	// Collect the metas first, as migrating objects moves them around
+	var metaFiles []string
 	filepath.Walk(this.cacheDir, func(path string, info os.FileInfo, err error) error {
-		if strings.Contains(path, "_meta_") {
-			metaJson, err := ioutil.ReadFile(path)
-			if err != nil {
-				log.Errorf("Unable to process meta from %s - %s", path, err)
-				return err
-			}
-
-			m := &source.Meta{}
-			err = json.Unmarshal(metaJson, m)
-			if err != nil {
-				log.Errorf("Unable to unmarshal meta from %s - %s", path, err)
-				return err
-			}
-
-			objectPath := strings.TrimPrefix(path, this.cacheDir)
-			objectPath = strings.TrimSuffix(objectPath, "._meta_")
-			log.Debugf("Adding meta %s", objectPath)
-			log.Debugf("    %+v", m)
-			this.AddMeta(m, objectPath)
+		// Left over from a meta write which never completed
+		if strings.HasSuffix(path, "._meta_.tmp") {
+			os.Remove(path)
+			return nil
+		}
+
+		if strings.HasSuffix(path, "._meta_") {
+			metaFiles = append(metaFiles, path)
 		}
 		return nil
 	})
+
+	for _, metaFile := range metaFiles {
+		this.importMetaFile(metaFile)
+	}
+
+	err := this.index.markImported()
+	if err != nil {
+		log.Errorf("Unable to update the cache index - %s", err)
+	}
+	log.Infof("Imported %d meta files", len(metaFiles))
+}
+
+func (this *S3Cache) importMetaFile(metaFile string) {
+	objectFile := strings.TrimSuffix(metaFile, "._meta_")
+	defer os.Remove(metaFile)
+
+	metaJson, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		log.Errorf("Unable to process meta from %s - %s", metaFile, err)
+		os.Remove(objectFile)
+		return
+	}
+
+	m := &source.Meta{}
+	err = json.Unmarshal(metaJson, m)
+	if err != nil {
+		log.Errorf("Unable to unmarshal meta from %s - %s", metaFile, err)
+		os.Remove(objectFile)
+		return
+	}
+
+	// Written before keys were hashed, when the path was the key
+	if m.Key == "" {
+		m.Key = strings.TrimPrefix(objectFile, this.cacheDir)
+	}
+
+	if objectFile != source.CachePath(this.cacheDir, m.Key) {
+		err = this.migrate(objectFile, m)
+		if err != nil {
+			log.Errorf("Unable to migrate %s - %s", objectFile, err)
+			os.Remove(objectFile)
+			return
+		}
+	}
+
+	err = this.index.put(m)
+	if err != nil {
+		log.Errorf("Unable to import meta from %s - %s", metaFile, err)
+	}
+}
+
+// migrate moves an object from the old layout, which mirrored the bucket and
+// key, to its hashed path.
+func (this *S3Cache) migrate(objectFile string, meta *source.Meta) error {
+	newFile := source.CachePath(this.cacheDir, meta.Key)
+	log.Infof("Migrating %s to %s", objectFile, newFile)
+
+	err := os.MkdirAll(path.Dir(newFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(objectFile, newFile)
 }
 
+// recoverable checks that the blocks a meta claims to have are actually on
+// disk. Metas written before progress was recorded have none at all; those
+// objects were always written sequentially, so are complete if they are the
+// full size.
+func recoverable(meta *source.Meta, objectFile string) bool {
+	info, err := os.Stat(objectFile)
+	if err != nil {
+		return false
+	}
+
+	legacy := meta.BlockSize == 0 && meta.Blocks == nil
+	if meta.Complete || legacy {
+		return info.Size() == meta.Size
+	}
+
+	if meta.BlockSize <= 0 || meta.Blocks == nil {
+		return false
+	}
+
+	numBlocks := int((meta.Size + int64(meta.BlockSize) - 1) / int64(meta.BlockSize))
+	for i := 0; i < numBlocks; i++ {
+		if !meta.Blocks.IsSet(i) {
+			continue
+		}
+		end := int64(i + 1) * int64(meta.BlockSize)
+		if end > meta.Size {
+			end = meta.Size
+		}
+		if end > info.Size() {
+			return false
+		}
+	}
+	return true
+}
+
+// discard removes an object which isn't in the cache from disk and the index.
+func (this *S3Cache) discard(key string) {
+	os.Remove(source.CachePath(this.cacheDir, key))
+	this.index.remove(key)
+}
+
+// IndexedMeta returns the meta of an object as persisted in the index, or nil
+// if there is none.
+func (this *S3Cache) IndexedMeta(uri string) *source.Meta {
+	meta, err := this.index.get(uri)
+	if err != nil {
+		log.Errorf("Unable to read meta for %s from the index - %s", uri, err)
+	}
+	return meta
+}
+
+// AddMeta adds an object which is already on disk. Unless the meta records
+// which blocks are present, the object is assumed to be complete.
 func (this *S3Cache) AddMeta(meta *source.Meta, objectPath string) {
-	dst := path.Join(this.cacheDir, objectPath)
+	entry := this.diskEntry(meta, objectPath)
+	if entry == nil {
+		return
+	}
+
+	wrapper := this.getOrCreateWrapper(objectPath)
+	wrapper.Lock()
+	wrapper.entry = entry
+	wrapper.Unlock()
+
+	entry.faultingFile.SetCheckpoint(this.checkpointer(wrapper, entry.faultingFile))
+}
+
+// diskEntry creates the entry for an object which is already on disk. It
+// returns nil if the object can't be used.
+func (this *S3Cache) diskEntry(meta *source.Meta, objectPath string) *cacheEntry {
+	dst := source.CachePath(this.cacheDir, objectPath)
+	meta.Key = objectPath
 	cc := this.blockCache.GetOrCreateSecondaryCache(objectPath)
 	ff, err := faulting.NewFaultingFile(nil, dst, meta.Size, cc)
 	if err != nil {
 		log.Errorf("Unable to recover meta for %s", objectPath)
-		return
+		return nil
 	}
-	ff.BlockCount = int((ff.Size / int64(ff.BlockSize)) + 1)
+
+	if meta.BlockSize > 0 {
+		ff.SetBlockSize(meta.BlockSize)
+	}
+	ff.SetSums(meta.BlockSums)
+	if this.policyFor(objectPath).NoMemory {
+		ff.DisableMemoryCache()
+	}
+	if this.source != nil && !this.offline {
+		ff.Fetcher = this.source.Fetcher(objectPath, meta.ETag)
+	}
+
+	// Offline, partial objects are kept for when the upstream is back
+	partial := !meta.Complete && meta.BlockSize > 0 && meta.Blocks != nil
+	if partial {
+		if ff.Fetcher == nil && !this.offline {
+			log.Infof("Unable to resume %s, discarding", objectPath)
+			this.discard(objectPath)
+			return nil
+		}
+		ff.SetBlocks(meta.Blocks)
+	} else {
+		ff.MarkComplete()
+	}
+
+	// Progress is only kept in the index
+	meta.Blocks = nil
+	meta.BlockSums = nil
 
 	entry := &cacheEntry{
 		key: objectPath,
 		meta: meta,
 		faultingFile: ff,
 	}
-	this.cachedFiles[objectPath] = &cacheEntryWrapper{
-		entry: entry,
+	if meta.LastAccess.IsZero() {
+		entry.touch()
+	} else {
+		entry.lastAccess = meta.LastAccess.UnixNano()
 	}
+	return entry
 }
 
-func writeMeta(meta *source.Meta, objectFile string) error {
-	metaJson, err := json.Marshal(meta)
-	if err != nil {
-		return err
-	}
+// checkpointer saves the meta of an entry along with the download progress of
+// its file.
+func (this *S3Cache) checkpointer(wrapper *cacheEntryWrapper, ff *faulting.FaultingFile) faulting.Checkpoint {
+	return func(blocks faulting.Bitmap, sums []uint32, complete bool) {
+		wrapper.Lock()
+		defer wrapper.Unlock()
 
-	metaFile := fmt.Sprintf("%s._meta_", objectFile)
-	err = ioutil.WriteFile(metaFile, metaJson, os.ModePerm|0755)
-	if err != nil {
-		return err
-	}
+		// Don't bring back the meta of an entry which has since been removed
+		if wrapper.entry == nil || wrapper.entry.faultingFile != ff || !this.inCache(ff.Dst) {
+			return
+		}
 
-	return nil
+		// Whatever arrived can't be trusted, so none of it is kept
+		if ff.Err() == faulting.ErrChecksum {
+			log.Errorf("Discarding %s, which doesn't match its checksum", wrapper.entry.key)
+			this.removeEntry(wrapper)
+			return
+		}
+
+		if ff.Verified() {
+			wrapper.entry.meta.Verified = true
+		}
+
+		meta := *wrapper.entry.meta
+		meta.LastAccess = time.Unix(0, atomic.LoadInt64(&wrapper.entry.lastAccess))
+		meta.Complete = complete
+		meta.BlockSize = ff.BlockSize
+		meta.BlockSums = sums
+		if !complete {
+			meta.Blocks = blocks
+		}
+
+		err := this.index.put(&meta)
+		if err != nil {
+			log.Errorf("ERROR saving meta for %s: %s", meta.Key, err)
+		}
+	}
 }
 
-func (this *S3Cache) validateEntry(ctx context.Context, uri string) {
+// validateEntry revalidates an expired entry. Within the revalidation window
+// the entry is served stale while it is revalidated in the background. After
+// that the upstream is checked inline. The request's Cache-Control can force
+// a revalidation, accept a stale entry or rule out going upstream at all.
+func (this *S3Cache) validateEntry(ctx context.Context, uri string) error {
 	// Early out if we're not currently caching this object
-	this.RLock()
-	wrapper, found := this.cachedFiles[uri]
-	this.RUnlock()
+	wrapper := this.getWrapper(uri)
+	if wrapper == nil {
+		return nil
+	}
 
 	ctxValue := ctx.Value(0).(*cache_context.Context)
+	request := requestControl(ctxValue)
 
-	if ! found || wrapper.entry == nil {
-		return
+	wrapper.RLock()
+	entry := wrapper.entry
+	var meta *source.Meta
+	if entry != nil && !entry.transient {
+		meta = entry.meta
+	}
+	wrapper.RUnlock()
+	if meta == nil {
+		return nil
 	}
 
-	// Has this entry already expired?
-	if wrapper.entry.meta.Expires.After(time.Now()) {
-		return
+	// Has this entry already expired, or does the request want it checked
+	// regardless?
+	now := time.Now()
+	expired := !meta.Expires.After(now)
+	forced := request.forcesRevalidation(meta)
+	if !expired && !forced {
+		return nil
+	}
+
+	if request.onlyIfCached {
+		ctxValue.Stale = expired
+		return nil
+	}
+
+	if !forced && request.acceptsStale(meta) {
+		log.Debugf("[%d] Serving stale %s, as requested", ctxValue.Sequence, uri)
+		ctxValue.Stale = true
+		return nil
+	}
+
+	policy := this.objectPolicy(uri, meta)
+	if policy.Revalidate == REVALIDATE_NEVER && !forced {
+		return nil
+	}
+
+	if this.offline {
+		log.Debugf("[%d] Offline, serving stale %s", ctxValue.Sequence, uri)
+		ctxValue.Stale = expired
+		return nil
+	}
+
+	if !forced && policy.Revalidate == REVALIDATE_BACKGROUND && now.Before(meta.Expires.Add(this.revalidateWindow)) {
+		ctxValue.Stale = true
+		this.revalidateAsync(ctxValue.Sequence, wrapper, entry)
+		return nil
 	}
 
 	wrapper.Lock()
 	defer wrapper.Unlock()
 
 	// Somebody else might have done this while we were waiting for the lock
-	if wrapper.entry == nil {
-		return
+	if wrapper.entry != entry || wrapper.entry.meta.Validated.After(now) {
+		return nil
 	}
 
 	// Get current Meta
-	meta, err := this.source.GetMeta(uri)
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == "NotFound" {
-				log.Infof("[%d] Upstream not found for %s", ctxValue.Sequence, uri)
-				this.Delete(ctx, uri)
-			}
-		} else {
-			log.Debugf("[%d] Unable to get meta: %s", ctxValue.Sequence, err)
-		}
-		return
+	current, err := this.source.GetMeta(uri)
+	stale, err := this.revalidated(ctxValue.Sequence, wrapper, current, err)
+	if stale {
+		ctxValue.Stale = true
 	}
+	return err
+}
 
-	// Check the ETag, Size and LastModified
-	if meta.ETag == wrapper.entry.meta.ETag &&
-			meta.Size == wrapper.entry.meta.Size &&
-			meta.LastModified == wrapper.entry.meta.LastModified {
-		wrapper.entry.meta.Expires = time.Now().Add(time.Duration(this.ttl) * time.Second)
-		log.Infof("[%d] Revalidated %s", ctxValue.Sequence, uri)
-		return
+// unservable returns why an entry can't be served as it is, if it can't.
+// Only complete objects can be served without going upstream.
+func (this *S3Cache) unservable(entry *cacheEntry, request cacheControl) error {
+	if entry.faultingFile.Complete() {
+		return nil
 	}
-
-	// If there is a change, then remove the currently cached entry
-	log.Debugf("[%d] Expiring %s", ctxValue.Sequence, uri)
-	this.Delete(ctx, uri)
+	if this.offline {
+		return ErrOffline
+	}
+	if request.onlyIfCached {
+		return ErrNotCached
+	}
+	return nil
 }
 
 func (this *S3Cache) Delete(ctx context.Context, uri string) {
 	ctxValue := ctx.Value(0).(*cache_context.Context)
 
-	this.RLock()
-	defer this.RUnlock()
+	this.metaLock.Lock()
+	delete(this.cachedMetas, uri)
+	delete(this.misses, uri)
+	this.metaLock.Unlock()
 
-	if wrapper, ok := this.cachedFiles[uri]; ok {
-		if wrapper.entry == nil {
-			return
-		}
-		log.Debugf("[%d] Deleting entry for request %s -> %s", ctxValue.Sequence, uri, wrapper.entry.faultingFile.Dst)
+	this.invalidateListings(uri)
 
-		meta := fmt.Sprintf("%s._meta_", wrapper.entry.faultingFile.Dst)
-		os.Remove(wrapper.entry.faultingFile.Dst)
-		os.Remove(meta)
-		this.blockCache.DeleteAll(uri)
+	wrapper := this.getWrapper(uri)
+	if wrapper == nil {
+		return
+	}
+
+	wrapper.Lock()
+	defer wrapper.Unlock()
 
-		wrapper.entry = nil
+	if wrapper.entry == nil {
+		return
+	}
+	log.Debugf("[%d] Deleting entry for request %s -> %s", ctxValue.Sequence, uri, wrapper.entry.faultingFile.Dst)
+	this.removeEntry(wrapper)
+}
+
+// removeEntry deletes a cached object, its indexed meta and any cached blocks. Must be
+// called with the wrapper's lock held.
+func (this *S3Cache) removeEntry(wrapper *cacheEntryWrapper) {
+	dst := wrapper.entry.faultingFile.Dst
+
+	// Never remove anything outside of the cache, such as /dev/null
+	if this.inCache(dst) {
+		os.Remove(dst)
+		this.index.remove(wrapper.entry.key)
 	}
+	this.blockCache.DeleteAll(wrapper.entry.key)
+
+	wrapper.entry = nil
+}
+
+func (this *S3Cache) inCache(file string) bool {
+	return strings.HasPrefix(file, this.cacheDir + "/")
 }
 
-func (this *S3Cache) Directory(path string) ([]string, error) {
+// Directory lists through the cache, so that each page of the listing is
+// cached.
+func (this *S3Cache) Directory(ctx context.Context, path string) ([]source.DirEntry, error) {
+	if this.offline || this.listingTTL > 0 {
+		return source.ListDirectory(&requestLister{this, ctx}, path)
+	}
 	return this.source.Directory(path)
-}
\ No newline at end of file
+}
+
+// requestLister lists on behalf of a single request.
+type requestLister struct {
+	cache *S3Cache
+	ctx   context.Context
+}
+
+func (this *requestLister) List(bucket string, opts *source.ListOptions) (*source.ObjectListing, error) {
+	return this.cache.List(this.ctx, bucket, opts)
+}
+
+func (this *requestLister) Buckets() ([]source.BucketInfo, error) {
+	return this.cache.Buckets()
+}
+
+func (this *S3Cache) List(ctx context.Context, bucket string, opts *source.ListOptions) (*source.ObjectListing, error) {
+	if this.offline {
+		// Which versions an object has can't be known from the cache
+		if opts.Versions {
+			return nil, ErrOffline
+		}
+		return this.offlineList(bucket, opts), nil
+	}
+	if this.listingTTL > 0 {
+		return this.cachedList(ctx, bucket, opts)
+	}
+	return this.source.List(bucket, opts)
+}
+
+func (this *S3Cache) Buckets() ([]source.BucketInfo, error) {
+	if this.offline {
+		return this.offlineBuckets(), nil
+	}
+	return this.source.Buckets()
+}
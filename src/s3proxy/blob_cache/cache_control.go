@@ -0,0 +1,136 @@
+package blob_cache
+
+import (
+	"errors"
+	"math"
+	"s3proxy/context"
+	"s3proxy/source"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotCached is returned when a request only accepts a cached object and
+// there isn't one.
+var ErrNotCached = errors.New("not cached")
+
+// cacheControl holds the Cache-Control directives which affect the cache,
+// whether set on an object or sent with a request. A negative maxAge or
+// maxStale means none was given.
+type cacheControl struct {
+	maxAge         time.Duration
+	maxStale       time.Duration
+	noCache        bool
+	noStore        bool
+	onlyIfCached   bool
+	mustRevalidate bool
+	immutable      bool
+}
+
+func parseCacheControl(header string) cacheControl {
+	cc := cacheControl{maxAge: -1, maxStale: -1}
+	sMaxAge := time.Duration(-1)
+
+	for _, directive := range strings.Split(header, ",") {
+		name := strings.ToLower(strings.TrimSpace(directive))
+		value := ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), "\"")
+		}
+
+		switch name {
+		case "max-age", "s-maxage":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				continue
+			}
+			if name == "max-age" {
+				cc.maxAge = time.Duration(seconds) * time.Second
+			} else {
+				sMaxAge = time.Duration(seconds) * time.Second
+			}
+		case "max-stale":
+			// Without a value, any staleness is acceptable
+			cc.maxStale = math.MaxInt64
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && seconds >= 0 {
+				cc.maxStale = time.Duration(seconds) * time.Second
+			}
+		case "no-cache":
+			cc.noCache = true
+		case "no-store":
+			cc.noStore = true
+		case "only-if-cached":
+			cc.onlyIfCached = true
+		case "must-revalidate", "proxy-revalidate":
+			cc.mustRevalidate = true
+		case "immutable":
+			cc.immutable = true
+		}
+	}
+
+	// The proxy is a shared cache
+	if sMaxAge >= 0 {
+		cc.maxAge = sMaxAge
+	}
+	return cc
+}
+
+// Versions of objects never change, so they are treated as fresh for this long
+const VERSION_TTL = 365 * 24 * time.Hour
+
+// objectPolicy refines the policy for an object with the Cache-Control and
+// Expires set on it in S3, which take precedence over the configured TTL.
+func (this *S3Cache) objectPolicy(uri string, meta *source.Meta) Policy {
+	objectUri, version := source.SplitVersion(uri)
+	policy := this.policyFor(objectUri)
+	cc := parseCacheControl(meta.CacheControl)
+
+	if cc.maxAge >= 0 {
+		policy.TTL = cc.maxAge
+	} else if !meta.UpstreamExpires.IsZero() {
+		policy.TTL = meta.UpstreamExpires.Sub(time.Now())
+		if policy.TTL < 0 {
+			policy.TTL = 0
+		}
+	}
+
+	if cc.noStore {
+		policy.NoCache = true
+	}
+
+	if cc.noCache {
+		policy.TTL = 0
+	}
+
+	if cc.noCache || cc.mustRevalidate {
+		policy.Revalidate = REVALIDATE_INLINE
+		policy.MustRevalidate = true
+	} else if cc.immutable {
+		policy.Revalidate = REVALIDATE_NEVER
+	}
+
+	if version != "" {
+		policy.TTL = VERSION_TTL
+		policy.Revalidate = REVALIDATE_NEVER
+		policy.MustRevalidate = false
+	}
+
+	return policy
+}
+
+// requestControl returns the Cache-Control directives sent with a request.
+func requestControl(ctxValue *cache_context.Context) cacheControl {
+	return parseCacheControl(ctxValue.CacheControl)
+}
+
+// forcesRevalidation reports whether a request needs an object revalidated,
+// however long it has left to live.
+func (this cacheControl) forcesRevalidation(meta *source.Meta) bool {
+	return this.noCache || (this.maxAge >= 0 && time.Since(meta.Validated) > this.maxAge)
+}
+
+// acceptsStale reports whether a request will take an expired object as it is.
+func (this cacheControl) acceptsStale(meta *source.Meta) bool {
+	return this.maxStale >= 0 && time.Now().Before(meta.Expires.Add(this.maxStale))
+}
@@ -15,19 +15,61 @@ import (
 	"sync"
 	"io"
 	"fmt"
+	"path"
+	"encoding/json"
+	"s3proxy/faulting"
+	"sync/atomic"
+	"strings"
 )
 
 var _ = Describe("Testing blob cache", func() {
-	Context("Sanity", func() {
-		It("Just works", func() {
-			cacheDir, err := ioutil.TempDir("", "cached-")
-			Expect(err).To(BeNil())
-			defer os.RemoveAll(cacheDir)
+	var cacheDir string
+	var bc *ccache.LayeredCache
+	var fus *fakes.FakeUpstreamSource
+	var cache *blob_cache.S3Cache
 
-			bc := ccache.Layered(ccache.Configure())
-			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
-			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+	BeforeEach(func() {
+		var err error
+		cacheDir, err = ioutil.TempDir("", "cached-")
+		Expect(err).To(BeNil())
 
+		bc = ccache.Layered(ccache.Configure())
+		fus = fakes.NewFakeUpstreamSource(cacheDir, bc)
+		cache = blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+	})
+
+	AfterEach(func() {
+		cache.Close()
+		os.RemoveAll(cacheDir)
+	})
+
+	// reopen replaces the cache with a new one on the same directory, as a
+	// restart would. The index can only be open once, so the old cache is
+	// closed first.
+	reopen := func(ttl int) {
+		cache.Close()
+		cache = blob_cache.NewS3Cache(bc, fus, cacheDir, ttl)
+	}
+
+	// readWith reads an object through the cache with the given request
+	// context, so that specs can set its cache directives and see whether
+	// the object was served stale.
+	readWith := func(ctxValue *cache_context.Context, uri string) (string, error) {
+		r, err := cache.Get(context.WithValue(context.Background(), 0, ctxValue), uri)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		return string(data), err
+	}
+
+	read := func(uri string) (string, error) {
+		return readWith(&cache_context.Context{Sequence: 1}, uri)
+	}
+
+	Context("Sanity", func() {
+		It("Just works", func() {
 			meta := &source.Meta {
 				Size: 1,
 				Expires: time.Now(),
@@ -42,7 +84,7 @@ var _ = Describe("Testing blob cache", func() {
 			for i = 0; i < 3; i++ {
 				x := i
 				go func() {
-					ctx := context.WithValue(context.Background(), 0, &cache_context.Context{x})
+					ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: x})
 					r, _ := cache.Get(ctx, "/cached/1000000")
 					var err error
 					buf := make([]byte, 65536)
@@ -63,4 +105,1068 @@ var _ = Describe("Testing blob cache", func() {
 			wg.Wait()
 		})
 	})
+
+	Context("Concurrent misses", func() {
+		It("only goes upstream once for the same key", func() {
+			wg := sync.WaitGroup{}
+			wg.Add(5)
+
+			var i uint64
+			for i = 0; i < 5; i++ {
+				x := i
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+
+					ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: x})
+					r, err := cache.Get(ctx, "/slow/10")
+					Expect(err).To(BeNil())
+					defer r.Close()
+
+					data, err := ioutil.ReadAll(r)
+					Expect(err).To(BeNil())
+					Expect(string(data)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+				}()
+			}
+			wg.Wait()
+
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("does not hold up other keys while going upstream", func() {
+			done := make(chan struct{})
+			go func() {
+				ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+				r, _ := cache.Get(ctx, "/slow/10")
+				r.Close()
+				close(done)
+			}()
+
+			// Give the slow miss a chance to start
+			time.Sleep(50 * time.Millisecond)
+
+			start := time.Now()
+			ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 2})
+			r, err := cache.Get(ctx, "/test_bucket/10")
+			Expect(err).To(BeNil())
+			r.Close()
+			Expect(time.Since(start)).To(BeNumerically("<", fakes.SlowGetDelay / 2))
+
+			<-done
+		})
+	})
+
+	Context("Verification", func() {
+		It("flags verified objects and discards corrupt ones", func() {
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			Eventually(func() bool {
+				return cache.GetMeta("/test_bucket/10").Verified
+			}).Should(BeTrue())
+
+			_, err := read("/corrupt/10")
+			Expect(err).To(Equal(faulting.ErrChecksum))
+
+			Eventually(func() *source.Meta {
+				return cache.GetMeta("/corrupt/10")
+			}).Should(BeNil())
+			Expect(cache.IndexedMeta("/corrupt/10")).To(BeNil())
+			_, err = os.Stat(source.CachePath(cacheDir, "/corrupt/10"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("Scrubbing", func() {
+		It("repairs corrupt objects and evicts those it can't repair", func() {
+			for _, uri := range []string{"/test_bucket/10", "/error/10"} {
+				ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+				r, err := cache.Get(ctx, uri)
+				Expect(err).To(BeNil())
+				ioutil.ReadAll(r)
+				r.Close()
+			}
+
+			repairable := source.CachePath(cacheDir, "/test_bucket/10")
+			unrepairable := source.CachePath(cacheDir, "/error/10")
+			for _, objectFile := range []string{repairable, unrepairable} {
+				Expect(ioutil.WriteFile(objectFile, []byte("rotten"), 0644)).To(Succeed())
+			}
+
+			cache.Scrub(0)
+
+			data, err := ioutil.ReadFile(repairable)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(cache.GetMeta("/test_bucket/10")).ToNot(BeNil())
+
+			Expect(cache.GetMeta("/error/10")).To(BeNil())
+			_, err = os.Stat(unrepairable)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("Recovery", func() {
+		// Objects are written the way older versions left them, with the
+		// meta next to the data, so that they have to be imported.
+		writeObject := func(objectFile, content string, meta *source.Meta) {
+			Expect(os.MkdirAll(path.Dir(objectFile), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(objectFile, []byte(content), 0644)).To(Succeed())
+			metaJson, err := json.Marshal(meta)
+			Expect(err).To(BeNil())
+			Expect(ioutil.WriteFile(objectFile + "._meta_", metaJson, 0644)).To(Succeed())
+		}
+
+		// Objects as the very first versions left them, before any progress
+		// was recorded
+		writeLegacyObject := func(objectFile, content string, size int) {
+			Expect(os.MkdirAll(path.Dir(objectFile), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(objectFile, []byte(content), 0644)).To(Succeed())
+			metaJson := fmt.Sprintf(`{"expires":"%s","last_modified":"2017-04-01T12:00:00Z","size":%d,"content_type":"binary/octet-stream","etag":%q}`,
+				time.Now().Add(time.Minute).Format(time.RFC3339Nano), size, fakes.NewIntegerStreamingSource(10).ETag())
+			Expect(ioutil.WriteFile(objectFile + "._meta_", []byte(metaJson), 0644)).To(Succeed())
+		}
+
+		It("records when a download is complete", func() {
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			Eventually(func() bool {
+				meta := cache.IndexedMeta("/test_bucket/10")
+				return meta != nil && meta.Complete
+			}).Should(BeTrue())
+
+			reopen(60)
+			cache.RecoverMeta()
+			Expect(cache.GetMeta("/test_bucket/10")).ToNot(BeNil())
+		})
+
+		It("keeps the headers set on objects", func() {
+			fus.Headers["/test_bucket/10"] = source.ObjectHeaders{
+				ContentEncoding: "gzip",
+				UserMeta: map[string]string{"Build-Id": "42"},
+			}
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			Eventually(func() bool {
+				meta := cache.IndexedMeta("/test_bucket/10")
+				return meta != nil && meta.Complete
+			}).Should(BeTrue())
+
+			reopen(60)
+			cache.RecoverMeta()
+			meta := cache.GetMeta("/test_bucket/10")
+			Expect(meta).ToNot(BeNil())
+			Expect(meta.ContentEncoding).To(Equal("gzip"))
+			Expect(meta.UserMeta).To(Equal(map[string]string{"Build-Id": "42"}))
+		})
+
+		It("keeps the headers refreshed by revalidating", func() {
+			reopen(0)
+			cache.SetRevalidateWindow(0)
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Eventually(func() bool {
+				meta := cache.IndexedMeta("/test_bucket/10")
+				return meta != nil && meta.Complete
+			}).Should(BeTrue())
+
+			fus.Headers["/test_bucket/10"] = source.ObjectHeaders{ContentLanguage: "de"}
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+
+			indexed := cache.IndexedMeta("/test_bucket/10")
+			Expect(indexed.ContentLanguage).To(Equal("de"))
+			Expect(indexed.Complete).To(BeTrue())
+
+			reopen(0)
+			cache.RecoverMeta()
+			Expect(cache.GetMeta("/test_bucket/10").ContentLanguage).To(Equal("de"))
+		})
+
+		It("resumes partial downloads", func() {
+			objectFile := source.CachePath(cacheDir, "/test_bucket/10")
+			blocks := faulting.NewBitmap(2)
+			blocks.Set(0)
+			writeObject(objectFile, "0 1 2 3 4 ", &source.Meta{
+				Key: "/test_bucket/10",
+				Size: 20,
+				ETag: fakes.NewIntegerStreamingSource(10).ETag(),
+				Expires: time.Now().Add(time.Minute),
+				BlockSize: 10,
+				Blocks: blocks,
+			})
+
+			cache.RecoverMeta()
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+			Eventually(func() bool {
+				return cache.IndexedMeta("/test_bucket/10").Complete
+			}).Should(BeTrue())
+			_, err := os.Stat(objectFile + "._meta_")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("keeps complete objects from before progress was recorded", func() {
+			writeLegacyObject(path.Join(cacheDir, "test_bucket", "10"), "0 1 2 3 4 5 6 7 8 9 ", 20)
+
+			cache.RecoverMeta()
+			Expect(cache.GetMeta("/test_bucket/10")).ToNot(BeNil())
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+		})
+
+		It("discards downloads from before progress was recorded which never finished", func() {
+			writeLegacyObject(path.Join(cacheDir, "test_bucket", "10"), "0 1 2 3 4 ", 20)
+
+			cache.RecoverMeta()
+
+			Expect(cache.GetMeta("/test_bucket/10")).To(BeNil())
+			_, err := os.Stat(source.CachePath(cacheDir, "/test_bucket/10"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(cache.IndexedMeta("/test_bucket/10")).To(BeNil())
+		})
+
+		It("migrates objects from the old layout", func() {
+			oldFile := path.Join(cacheDir, "test_bucket", "10")
+			writeLegacyObject(oldFile, "0 1 2 3 4 5 6 7 8 9 ", 20)
+
+			cache.RecoverMeta()
+
+			_, err := os.Stat(oldFile)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			_, err = os.Stat(oldFile + "._meta_")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(cache.IndexedMeta("/test_bucket/10").Key).To(Equal("/test_bucket/10"))
+
+			newFile := source.CachePath(cacheDir, "/test_bucket/10")
+			data, err := ioutil.ReadFile(newFile)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+		})
+
+		It("only imports meta files once", func() {
+			cache.RecoverMeta()
+
+			objectFile := source.CachePath(cacheDir, "/test_bucket/10")
+			writeObject(objectFile, "0 1 2 3 4 5 6 7 8 9 ", &source.Meta{
+				Key: "/test_bucket/10",
+				Size: 20,
+				Expires: time.Now().Add(time.Minute),
+				Complete: true,
+			})
+
+			reopen(60)
+			cache.RecoverMeta()
+			Expect(cache.GetMeta("/test_bucket/10")).To(BeNil())
+		})
+
+		It("remembers when objects were last read", func() {
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			Eventually(func() bool {
+				meta := cache.IndexedMeta("/test_bucket/10")
+				return meta != nil && !meta.LastAccess.IsZero()
+			}).Should(BeTrue())
+		})
+	})
+
+	Context("Stale content", func() {
+		BeforeEach(func() {
+			reopen(0)
+		})
+
+		It("serves expired objects while the upstream is unavailable", func() {
+			cache.SetRevalidateWindow(0)
+			ctxValue := &cache_context.Context{Sequence: 1}
+			_, err := readWith(ctxValue, "/test_bucket/10")
+			Expect(err).To(BeNil())
+			Expect(ctxValue.Stale).To(BeFalse())
+
+			fus.SetUnavailable(true)
+			ctxValue = &cache_context.Context{Sequence: 2}
+			data, err := readWith(ctxValue, "/test_bucket/10")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(ctxValue.Stale).To(BeTrue())
+
+			fus.SetUnavailable(false)
+			ctxValue = &cache_context.Context{Sequence: 3}
+			_, err = readWith(ctxValue, "/test_bucket/10")
+			Expect(err).To(BeNil())
+			Expect(ctxValue.Stale).To(BeFalse())
+		})
+
+		It("stops serving expired objects after the grace period", func() {
+			cache.SetStaleGrace(0)
+			cache.SetRevalidateWindow(0)
+			_, err := read("/test_bucket/10")
+			Expect(err).To(BeNil())
+
+			fus.SetUnavailable(true)
+			_, err = read("/test_bucket/10")
+			Expect(err).To(Equal(fakes.ErrUnavailable))
+			Expect(cache.GetMeta("/test_bucket/10")).ToNot(BeNil())
+		})
+
+		It("revalidates expired objects in the background", func() {
+			_, err := read("/slow/10")
+			Expect(err).To(BeNil())
+
+			// Revalidating takes a while, but nobody waits for it
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				ctxValue := &cache_context.Context{Sequence: 1}
+				data, err := readWith(ctxValue, "/slow/10")
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+				Expect(ctxValue.Stale).To(BeTrue())
+			}
+			Expect(time.Since(start)).To(BeNumerically("<", fakes.SlowGetDelay))
+
+			time.Sleep(2 * fakes.SlowGetDelay)
+			Expect(atomic.LoadInt32(&fus.GetMetaCount)).To(Equal(int32(1)))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("revalidates inline once the window has passed", func() {
+			cache.SetRevalidateWindow(0)
+			_, err := read("/test_bucket/10")
+			Expect(err).To(BeNil())
+
+			ctxValue := &cache_context.Context{Sequence: 2}
+			_, err = readWith(ctxValue, "/test_bucket/10")
+			Expect(err).To(BeNil())
+			Expect(ctxValue.Stale).To(BeFalse())
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+		})
+
+		It("only serves what is on disk when offline", func() {
+			_, err := read("/test_bucket/10")
+			Expect(err).To(BeNil())
+			Eventually(func() bool {
+				meta := cache.IndexedMeta("/test_bucket/10")
+				return meta != nil && meta.Complete
+			}).Should(BeTrue())
+
+			cache.Close()
+			cache = blob_cache.NewS3Cache(ccache.Layered(ccache.Configure()), fus, cacheDir, 0)
+			cache.SetOffline(true)
+			cache.RecoverMeta()
+			getCount := fus.GetCount
+			getMetaCount := fus.GetMetaCount
+
+			ctxValue := &cache_context.Context{Sequence: 2}
+			data, err := readWith(ctxValue, "/test_bucket/10")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(ctxValue.Stale).To(BeTrue())
+
+			_, err = read("/test_bucket/5")
+			Expect(err).To(Equal(blob_cache.ErrOffline))
+
+			ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+			listing, err := cache.List(ctx, "test_bucket", &source.ListOptions{})
+			Expect(err).To(BeNil())
+			Expect(listing.Objects).To(HaveLen(1))
+			Expect(listing.Objects[0].Key).To(Equal("10"))
+
+			entries, err := cache.Directory(ctx, "/")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name).To(Equal("test_bucket/"))
+
+			Expect(fus.GetCount).To(Equal(getCount))
+			Expect(fus.GetMetaCount).To(Equal(getMetaCount))
+		})
+	})
+
+	Context("Missing objects", func() {
+		get := func(uri string) error {
+			_, err := read(uri)
+			return err
+		}
+
+		It("remembers missing objects", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(get("/missing/10")).ToNot(BeNil())
+				}()
+			}
+			wg.Wait()
+			Expect(atomic.LoadInt32(&fus.GetCount)).To(Equal(int32(1)))
+
+			ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+			_, err := cache.Stat(ctx, "/missing/10")
+			Expect(err).ToNot(BeNil())
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+		})
+
+		It("forgets missing objects when they are deleted", func() {
+			Expect(get("/missing/10")).ToNot(BeNil())
+			cache.Delete(context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1}), "/missing/10")
+			Expect(get("/missing/10")).ToNot(BeNil())
+			Expect(fus.GetCount).To(Equal(int32(2)))
+		})
+
+		It("forgets missing objects after their TTL", func() {
+			cache.SetNegativeTTL(50 * time.Millisecond, false)
+			Expect(get("/missing/10")).ToNot(BeNil())
+			Expect(get("/missing/10")).ToNot(BeNil())
+			Expect(fus.GetCount).To(Equal(int32(1)))
+
+			time.Sleep(100 * time.Millisecond)
+			Expect(get("/missing/10")).ToNot(BeNil())
+			Expect(fus.GetCount).To(Equal(int32(2)))
+		})
+
+		It("only remembers forbidden objects if asked to", func() {
+			Expect(get("/forbidden/10")).ToNot(BeNil())
+			Expect(get("/forbidden/10")).ToNot(BeNil())
+			Expect(fus.GetCount).To(Equal(int32(2)))
+
+			cache.SetNegativeTTL(time.Minute, true)
+			Expect(get("/forbidden/10")).ToNot(BeNil())
+			Expect(get("/forbidden/10")).ToNot(BeNil())
+			Expect(fus.GetCount).To(Equal(int32(3)))
+		})
+	})
+
+	Context("Listings", func() {
+		var ctx context.Context
+
+		BeforeEach(func() {
+			fus.Objects["test_bucket"] = []string{"a/1", "a/2", "b/1", "c"}
+			fus.Objects["slow"] = []string{"a/1"}
+			ctx = context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+		})
+
+		list := func(bucket, prefix string) *source.ObjectListing {
+			listing, err := cache.List(ctx, bucket, &source.ListOptions{Prefix: prefix})
+			Expect(err).To(BeNil())
+			return listing
+		}
+
+		It("caches listings", func() {
+			Expect(list("test_bucket", "a/").Objects).To(HaveLen(2))
+			Expect(list("test_bucket", "a/").Objects).To(HaveLen(2))
+			Expect(fus.ListCount).To(Equal(int32(1)))
+
+			entries, err := cache.Directory(ctx, "/test_bucket/")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+			_, err = cache.Directory(ctx, "/test_bucket/")
+			Expect(err).To(BeNil())
+			Expect(fus.ListCount).To(Equal(int32(2)))
+		})
+
+		It("shares a single upstream request between concurrent listings", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(list("slow", "").Objects).To(HaveLen(1))
+				}()
+			}
+			wg.Wait()
+			Expect(atomic.LoadInt32(&fus.ListCount)).To(Equal(int32(1)))
+		})
+
+		It("invalidates listings when an object is deleted", func() {
+			list("test_bucket", "a/")
+			list("test_bucket", "b/")
+			list("test_bucket", "")
+			Expect(fus.ListCount).To(Equal(int32(3)))
+
+			cache.Delete(ctx, "/test_bucket/a/1")
+			list("test_bucket", "a/")
+			list("test_bucket", "b/")
+			list("test_bucket", "")
+			Expect(fus.ListCount).To(Equal(int32(5)))
+		})
+
+		It("serves expired listings while the upstream is unavailable", func() {
+			cache.SetListingTTL(time.Millisecond)
+			list("test_bucket", "a/")
+			time.Sleep(10 * time.Millisecond)
+
+			fus.SetUnavailable(true)
+			Expect(list("test_bucket", "a/").Objects).To(HaveLen(2))
+			Expect(fus.ListCount).To(Equal(int32(2)))
+
+			_, err := cache.List(ctx, "test_bucket", &source.ListOptions{Prefix: "b/"})
+			Expect(err).To(Equal(fakes.ErrUnavailable))
+		})
+
+		It("marks expired listings as stale", func() {
+			cache.SetListingTTL(time.Millisecond)
+			list("test_bucket", "a/")
+			time.Sleep(10 * time.Millisecond)
+
+			fus.SetUnavailable(true)
+			ctxValue := &cache_context.Context{Sequence: 1}
+			listing, err := cache.List(context.WithValue(context.Background(), 0, ctxValue), "test_bucket", &source.ListOptions{Prefix: "a/"})
+			Expect(err).To(BeNil())
+			Expect(listing.Objects).To(HaveLen(2))
+			Expect(ctxValue.Stale).To(BeTrue())
+
+			fus.SetUnavailable(false)
+			ctxValue = &cache_context.Context{Sequence: 2}
+			_, err = cache.List(context.WithValue(context.Background(), 0, ctxValue), "test_bucket", &source.ListOptions{Prefix: "a/"})
+			Expect(err).To(BeNil())
+			Expect(ctxValue.Stale).To(BeFalse())
+		})
+	})
+
+	Context("Policies", func() {
+		BeforeEach(func() {
+			policyFile := path.Join(cacheDir, "policies.yml")
+			Expect(ioutil.WriteFile(policyFile, []byte(`
+policies:
+  - bucket: test_bucket
+    prefix: latest/
+    ttl: 0
+    revalidate: inline
+  - bucket: "test_*"
+    prefix: releases/
+    ttl: 0
+    revalidate: never
+  - prefix: tmp/
+    cache: false
+  - bucket: big
+    max_size: 10
+  - match: "iso/*"
+    memory: false
+`), 0644)).To(Succeed())
+
+			table, err := blob_cache.LoadPolicies(policyFile)
+			Expect(err).To(BeNil())
+			cache.SetPolicies(table)
+		})
+
+		It("rejects invalid policies", func() {
+			policyFile := path.Join(cacheDir, "invalid.yml")
+			Expect(ioutil.WriteFile(policyFile, []byte("policies:\n  - revalidate: sometimes\n"), 0644)).To(Succeed())
+			_, err := blob_cache.LoadPolicies(policyFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("uses the TTL and revalidation mode of the first matching policy", func() {
+			Expect(read("/test_bucket/latest/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/latest/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+
+			Expect(read("/test_bucket/releases/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/releases/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+			Expect(fus.GetCount).To(Equal(int32(3)))
+		})
+
+		It("doesn't keep objects which mustn't be cached", func() {
+			Expect(read("/test_bucket/tmp/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Eventually(func() *source.Meta {
+				return cache.GetMeta("/test_bucket/tmp/10")
+			}).Should(BeNil())
+			_, err := os.Stat(source.CachePath(cacheDir, "/test_bucket/tmp/10"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(cache.IndexedMeta("/test_bucket/tmp/10")).To(BeNil())
+
+			Expect(read("/test_bucket/tmp/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetCount).To(Equal(int32(2)))
+		})
+
+		It("doesn't keep objects which are too large", func() {
+			Expect(read("/big/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/big/4")).To(Equal("0 1 2 3 "))
+			Eventually(func() *source.Meta {
+				return cache.GetMeta("/big/10")
+			}).Should(BeNil())
+			Expect(cache.GetMeta("/big/4")).ToNot(BeNil())
+		})
+
+		It("keeps objects out of memory", func() {
+			Expect(read("/test_bucket/iso/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(bc.Get("/test_bucket/iso/10", "0")).To(BeNil())
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(bc.Get("/test_bucket/10", "0")).ToNot(BeNil())
+		})
+	})
+
+	Context("Object cache headers", func() {
+		// The object's own headers are what decide, so revalidation isn't
+		// held back by the window
+		withTTL := func(ttl int) {
+			reopen(ttl)
+			cache.SetRevalidateWindow(0)
+		}
+
+		It("uses max-age instead of the TTL", func() {
+			fus.CacheControl["/test_bucket/10"] = "public, max-age=60"
+			withTTL(0)
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+		})
+
+		It("uses Expires instead of the TTL", func() {
+			fus.Expires["/test_bucket/10"] = time.Now().Add(time.Hour)
+			withTTL(0)
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+		})
+
+		It("revalidates no-cache objects on every request", func() {
+			fus.CacheControl["/test_bucket/10"] = "no-cache"
+			withTTL(60)
+			cache.SetRevalidateWindow(time.Minute)
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(2)))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("doesn't keep no-store objects", func() {
+			fus.CacheControl["/test_bucket/10"] = "no-store"
+			withTTL(60)
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Eventually(func() *source.Meta {
+				return cache.GetMeta("/test_bucket/10")
+			}).Should(BeNil())
+		})
+
+		It("never serves must-revalidate objects stale", func() {
+			fus.CacheControl["/test_bucket/10"] = "must-revalidate"
+			withTTL(0)
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			fus.SetUnavailable(true)
+			_, err := read("/test_bucket/10")
+			Expect(err).To(Equal(fakes.ErrUnavailable))
+		})
+
+		It("never revalidates immutable objects", func() {
+			fus.CacheControl["/test_bucket/10"] = "immutable"
+			withTTL(0)
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+		})
+	})
+
+	Context("Request cache directives", func() {
+		BeforeEach(func() {
+			cache.SetRevalidateWindow(0)
+		})
+
+		withTTL := func(ttl int) {
+			reopen(ttl)
+			cache.SetRevalidateWindow(0)
+		}
+
+		// request reads an object with the given Cache-Control, returning the
+		// request's context
+		request := func(uri string, cacheControl string) (*cache_context.Context, error) {
+			ctxValue := &cache_context.Context{Sequence: 1, CacheControl: cacheControl}
+			_, err := readWith(ctxValue, uri)
+			return ctxValue, err
+		}
+
+		It("revalidates fresh objects for no-cache", func() {
+			_, err := request("/test_bucket/10", "")
+			Expect(err).To(BeNil())
+			_, err = request("/test_bucket/10", "no-cache")
+			Expect(err).To(BeNil())
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("revalidates objects older than max-age", func() {
+			_, err := request("/test_bucket/10", "")
+			Expect(err).To(BeNil())
+			_, err = request("/test_bucket/10", "max-age=60")
+			Expect(err).To(BeNil())
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+
+			time.Sleep(10 * time.Millisecond)
+			_, err = request("/test_bucket/10", "max-age=0")
+			Expect(err).To(BeNil())
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+		})
+
+		It("looks past a cached miss for no-cache", func() {
+			_, err := request("/missing/10", "")
+			Expect(err).ToNot(BeNil())
+			_, err = request("/missing/10", "no-cache")
+			Expect(err).ToNot(BeNil())
+			Expect(fus.GetCount).To(Equal(int32(2)))
+		})
+
+		It("never goes upstream for only-if-cached", func() {
+			_, err := request("/test_bucket/10", "only-if-cached")
+			Expect(err).To(Equal(blob_cache.ErrNotCached))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+
+			ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1, CacheControl: "only-if-cached"})
+			_, err = cache.Stat(ctx, "/test_bucket/10")
+			Expect(err).To(Equal(blob_cache.ErrNotCached))
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+		})
+
+		It("serves expired objects for only-if-cached", func() {
+			withTTL(0)
+			_, err := request("/test_bucket/10", "")
+			Expect(err).To(BeNil())
+
+			ctxValue, err := request("/test_bucket/10", "only-if-cached")
+			Expect(err).To(BeNil())
+			Expect(ctxValue.Stale).To(BeTrue())
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+		})
+
+		It("serves expired objects within max-stale", func() {
+			withTTL(0)
+			_, err := request("/test_bucket/10", "")
+			Expect(err).To(BeNil())
+
+			ctxValue, err := request("/test_bucket/10", "max-stale=60")
+			Expect(err).To(BeNil())
+			Expect(ctxValue.Stale).To(BeTrue())
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+
+			_, err = request("/test_bucket/10", "max-stale=0")
+			Expect(err).To(BeNil())
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+		})
+
+		It("doesn't keep objects fetched for no-store", func() {
+			_, err := request("/test_bucket/10", "no-store")
+			Expect(err).To(BeNil())
+			Eventually(func() *source.Meta {
+				return cache.GetMeta("/test_bucket/10")
+			}).Should(BeNil())
+		})
+	})
+
+	Context("Versions", func() {
+		BeforeEach(func() {
+			fus.Versions["/test_bucket/10"] = []string{"v2", "v1"}
+			reopen(0)
+			cache.SetRevalidateWindow(0)
+		})
+
+		It("caches versions independently", func() {
+			Expect(read(source.VersionedUri("/test_bucket/10", "v1"))).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read(source.VersionedUri("/test_bucket/10", "v2"))).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetCount).To(Equal(int32(3)))
+
+			Expect(cache.GetMeta(source.VersionedUri("/test_bucket/10", "v1")).VersionId).To(Equal("v1"))
+			Expect(cache.GetMeta(source.VersionedUri("/test_bucket/10", "v2")).VersionId).To(Equal("v2"))
+		})
+
+		It("never revalidates versions", func() {
+			Expect(read(source.VersionedUri("/test_bucket/10", "v1"))).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read(source.VersionedUri("/test_bucket/10", "v1"))).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+		})
+
+		It("remembers missing versions", func() {
+			_, err := read(source.VersionedUri("/test_bucket/10", "v9"))
+			Expect(err).ToNot(BeNil())
+			_, err = read(source.VersionedUri("/test_bucket/10", "v9"))
+			Expect(err).ToNot(BeNil())
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("doesn't mistake keys which look like versions for versions", func() {
+			_, err := read("/test_bucket/10?versionId=v9")
+			Expect(err).To(BeNil())
+			Expect(cache.GetMeta("/test_bucket/10?versionId=v9").VersionId).To(Equal(""))
+			Expect(cache.GetMeta(source.VersionedUri("/test_bucket/10", "v9"))).To(BeNil())
+		})
+
+		It("lists versions", func() {
+			fus.Objects["test_bucket"] = []string{"10", "20"}
+			ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+			listing, err := cache.List(ctx, "test_bucket", &source.ListOptions{Versions: true})
+			Expect(err).To(BeNil())
+			Expect(listing.Objects).To(HaveLen(3))
+			Expect(listing.Objects[0].VersionId).To(Equal("v2"))
+			Expect(listing.Objects[0].IsLatest).To(BeTrue())
+			Expect(listing.Objects[2].VersionId).To(Equal("null"))
+		})
+
+		It("leaves versions out of offline listings", func() {
+			Expect(read(source.VersionedUri("/test_bucket/10", "v1"))).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			Eventually(func() bool {
+				meta := cache.IndexedMeta("/test_bucket/10")
+				return meta != nil && meta.Complete
+			}).Should(BeTrue())
+			Eventually(func() bool {
+				meta := cache.IndexedMeta(source.VersionedUri("/test_bucket/10", "v1"))
+				return meta != nil && meta.Complete
+			}).Should(BeTrue())
+
+			cache.Close()
+			cache = blob_cache.NewS3Cache(ccache.Layered(ccache.Configure()), fus, cacheDir, 0)
+			cache.SetOffline(true)
+			cache.RecoverMeta()
+
+			ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+			listing, err := cache.List(ctx, "test_bucket", &source.ListOptions{})
+			Expect(err).To(BeNil())
+			Expect(listing.Objects).To(HaveLen(1))
+			Expect(listing.Objects[0].Key).To(Equal("10"))
+
+			_, err = cache.List(ctx, "test_bucket", &source.ListOptions{Versions: true})
+			Expect(err).To(Equal(blob_cache.ErrOffline))
+		})
+	})
+
+	Context("Writes", func() {
+		var ctx context.Context
+
+		BeforeEach(func() {
+			ctx = context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+		})
+
+		It("serves what was put from the cache", func() {
+			meta, err := cache.Put(ctx, "/test_bucket/new", strings.NewReader("hello world"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			Expect(meta.Size).To(Equal(int64(11)))
+
+			Expect(read("/test_bucket/new")).To(Equal("hello world"))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+			Expect(fus.PutCount).To(Equal(int32(1)))
+		})
+
+		It("replaces what was cached before", func() {
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			_, err := cache.Put(ctx, "/test_bucket/10", strings.NewReader("replaced"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			Expect(read("/test_bucket/10")).To(Equal("replaced"))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("keeps serving readers of what was replaced", func() {
+			r, err := cache.Get(ctx, "/test_bucket/10")
+			Expect(err).To(BeNil())
+
+			_, err = cache.Put(ctx, "/test_bucket/10", strings.NewReader("replaced"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			Expect(read("/test_bucket/10")).To(Equal("replaced"))
+
+			data, err := ioutil.ReadAll(r)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			r.Close()
+
+			Expect(read("/test_bucket/10")).To(Equal("replaced"))
+			Eventually(func() []os.FileInfo {
+				files, _ := ioutil.ReadDir(path.Join(cacheDir, blob_cache.UPLOADS_DIR))
+				return files
+			}).Should(BeEmpty())
+		})
+
+		It("forgets that the object was missing", func() {
+			_, err := read("/missing/10")
+			Expect(err).ToNot(BeNil())
+
+			_, err = cache.Put(ctx, "/missing/10", strings.NewReader("found"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			Expect(read("/missing/10")).To(Equal("found"))
+
+			_, err = cache.Stat(ctx, "/missing/10")
+			Expect(err).To(BeNil())
+		})
+
+		It("drops the listings the object appears in", func() {
+			fus.Objects["test_bucket"] = []string{"10"}
+			cache.SetListingTTL(time.Minute)
+
+			_, err := cache.List(ctx, "test_bucket", &source.ListOptions{})
+			Expect(err).To(BeNil())
+			_, err = cache.Put(ctx, "/test_bucket/new", strings.NewReader("hello"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			_, err = cache.List(ctx, "test_bucket", &source.ListOptions{})
+			Expect(err).To(BeNil())
+			Expect(fus.ListCount).To(Equal(int32(2)))
+		})
+
+		It("keeps what was put across restarts", func() {
+			_, err := cache.Put(ctx, "/test_bucket/new", strings.NewReader("hello world"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			Expect(cache.IndexedMeta("/test_bucket/new").Complete).To(BeTrue())
+
+			cache.Close()
+			recovered := blob_cache.NewS3Cache(ccache.Layered(ccache.Configure()), fus, cacheDir, 60)
+			recovered.RecoverMeta()
+			cache = recovered
+			Expect(read("/test_bucket/new")).To(Equal("hello world"))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+		})
+
+		It("caches multipart uploads once they are complete", func() {
+			uploadId, err := cache.CreateMultipartUpload(ctx, "/test_bucket/new", &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+
+			var parts []source.CompletedPart
+			for i, part := range []string{"hello", " world"} {
+				etag, err := cache.UploadPart(ctx, "/test_bucket/new", uploadId, int64(i + 1), strings.NewReader(part), &source.UploadOptions{})
+				Expect(err).To(BeNil())
+				parts = append(parts, source.CompletedPart{PartNumber: int64(i + 1), ETag: etag})
+			}
+			Expect(cache.GetMeta("/test_bucket/new")).To(BeNil())
+
+			meta, err := cache.CompleteMultipartUpload(ctx, "/test_bucket/new", uploadId, parts, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			Expect(meta.Size).To(Equal(int64(11)))
+			Expect(read("/test_bucket/new")).To(Equal("hello world"))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+
+			_, err = os.Stat(path.Join(cacheDir, blob_cache.UPLOADS_DIR))
+			Expect(err).To(BeNil())
+			files, err := ioutil.ReadDir(path.Join(cacheDir, blob_cache.UPLOADS_DIR))
+			Expect(err).To(BeNil())
+			Expect(files).To(BeEmpty())
+		})
+
+		It("answers writes which can't be read back without caching them", func() {
+			meta, err := cache.Put(ctx, "/unreadable/new", strings.NewReader("hello world"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(BeNil())
+			Expect(meta.ETag).ToNot(BeEmpty())
+
+			Expect(cache.GetMeta("/unreadable/new")).To(BeNil())
+			Expect(cache.IndexedMeta("/unreadable/new")).To(BeNil())
+			_, err = os.Stat(source.CachePath(cacheDir, "/unreadable/new"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("refuses writes while offline", func() {
+			cache.SetOffline(true)
+			_, err := cache.Put(ctx, "/test_bucket/new", strings.NewReader("hello"), &source.Meta{}, &source.UploadOptions{})
+			Expect(err).To(Equal(blob_cache.ErrOffline))
+			Expect(fus.PutCount).To(Equal(int32(0)))
+		})
+	})
+
+	Context("Cache paths", func() {
+		It("caches keys which can't be mapped directly onto the filesystem", func() {
+			uris := []string{"/test_bucket/10", "/test_bucket/10/5", "/test_bucket/../../3", "/test_bucket/ünï_meta_/4"}
+			for _, uri := range uris {
+				Expect(source.CachePath(cacheDir, uri)).To(HavePrefix(cacheDir + "/"))
+
+				_, err := read(uri)
+				Expect(err).To(BeNil())
+			}
+
+			reopen(60)
+			Eventually(func() int {
+				cache.RecoverMeta()
+				count := 0
+				for _, uri := range uris {
+					if cache.GetMeta(uri) != nil {
+						count++
+					}
+				}
+				return count
+			}).Should(Equal(len(uris)))
+		})
+	})
+
+	Context("Disk limits", func() {
+		It("evicts the least recently used objects", func() {
+			cache.SetDiskLimit(35, 0)
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/5")).To(Equal("0 1 2 3 4 "))
+			time.Sleep(10 * time.Millisecond)
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(read("/test_bucket/4")).To(Equal("0 1 2 3 "))
+
+			Eventually(func() *source.Meta {
+				cache.EnforceDiskLimit()
+				return cache.GetMeta("/test_bucket/5")
+			}).Should(BeNil())
+
+			Expect(cache.GetMeta("/test_bucket/10")).ToNot(BeNil())
+			Expect(cache.GetMeta("/test_bucket/4")).ToNot(BeNil())
+
+			_, err := os.Stat(source.CachePath(cacheDir, "/test_bucket/5"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			_, err = os.Stat(source.CachePath(cacheDir, "/test_bucket/5") + "._meta_")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("does not evict objects which are being read", func() {
+			cache.SetDiskLimit(10, 0)
+
+			ctx := context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: 1})
+			r, err := cache.Get(ctx, "/test_bucket/10")
+			Expect(err).To(BeNil())
+
+			Consistently(func() *source.Meta {
+				cache.EnforceDiskLimit()
+				return cache.GetMeta("/test_bucket/10")
+			}, "200ms").ShouldNot(BeNil())
+
+			data, err := ioutil.ReadAll(r)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			r.Close()
+
+			Eventually(func() *source.Meta {
+				cache.EnforceDiskLimit()
+				return cache.GetMeta("/test_bucket/10")
+			}).Should(BeNil())
+		})
+
+		It("counts uploads towards the limit and removes abandoned ones", func() {
+			cache.SetDiskLimit(35, 0)
+
+			Expect(read("/test_bucket/10")).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+			abandoned := path.Join(cacheDir, blob_cache.UPLOADS_DIR, "abandoned")
+			Expect(os.MkdirAll(abandoned, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path.Join(abandoned, "1-part"), make([]byte, 100), 0644)).To(Succeed())
+			old := time.Now().Add(-blob_cache.UPLOAD_TTL - time.Hour)
+			Expect(os.Chtimes(abandoned, old, old)).To(Succeed())
+
+			current := path.Join(cacheDir, blob_cache.UPLOADS_DIR, "current")
+			Expect(os.MkdirAll(current, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path.Join(current, "1-part"), make([]byte, 30), 0644)).To(Succeed())
+
+			Eventually(func() *source.Meta {
+				cache.EnforceDiskLimit()
+				return cache.GetMeta("/test_bucket/10")
+			}).Should(BeNil())
+
+			_, err := os.Stat(abandoned)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			_, err = os.Stat(path.Join(current, "1-part"))
+			Expect(err).To(BeNil())
+		})
+	})
 })
@@ -0,0 +1,138 @@
+package blob_cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Multipart uploads which haven't had a part for this long are taken to be
+// abandoned, and their parts are removed from disk.
+const UPLOAD_TTL = 24 * time.Hour
+
+// SetDiskLimit bounds the space used by cached objects, either as a number of
+// bytes or as a percentage of the filesystem holding the cache directory. A
+// limit of 0 is ignored; if both are set the smaller one applies.
+func (this *S3Cache) SetDiskLimit(maxBytes int64, maxPercent int) {
+	this.maxDiskBytes = maxBytes
+	this.maxDiskPercent = maxPercent
+}
+
+func (this *S3Cache) diskLimit() int64 {
+	limit := this.maxDiskBytes
+
+	if this.maxDiskPercent > 0 {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(this.cacheDir, &stat)
+		if err != nil {
+			log.Errorf("Unable to determine size of filesystem for %s: %s", this.cacheDir, err)
+		} else {
+			fsLimit := int64(stat.Blocks) * int64(stat.Bsize) * int64(this.maxDiskPercent) / 100
+			if limit == 0 || fsLimit < limit {
+				limit = fsLimit
+			}
+		}
+	}
+
+	return limit
+}
+
+// EnforceDiskLimit evicts the least recently used objects until the cache fits
+// within its disk limit. Objects which are still downloading or being read
+// are skipped so that no reader loses its file. Uploads count towards the
+// limit too, and abandoned ones are removed.
+func (this *S3Cache) EnforceDiskLimit() {
+	// One eviction pass at a time is plenty
+	if !atomic.CompareAndSwapInt32(&this.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&this.evicting, 0)
+
+	uploads := this.expireUploads()
+
+	limit := this.diskLimit()
+	if limit <= 0 {
+		return
+	}
+
+	type candidate struct {
+		wrapper    *cacheEntryWrapper
+		size       int64
+		lastAccess int64
+	}
+
+	used := uploads
+	var candidates []candidate
+	for _, wrapper := range this.wrappers() {
+		wrapper.RLock()
+		if wrapper.entry != nil {
+			used += wrapper.entry.meta.Size
+			candidates = append(candidates, candidate{
+				wrapper: wrapper,
+				size: wrapper.entry.meta.Size,
+				lastAccess: atomic.LoadInt64(&wrapper.entry.lastAccess),
+			})
+		}
+		wrapper.RUnlock()
+	}
+
+	if used <= limit {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccess < candidates[j].lastAccess
+	})
+
+	for _, c := range candidates {
+		if used <= limit {
+			break
+		}
+
+		// Holding the entry's lock keeps new readers out while we check
+		c.wrapper.Lock()
+		if c.wrapper.entry != nil && !c.wrapper.entry.faultingFile.InUse() {
+			log.Infof("Evicting %s (%d bytes) to stay within disk limit of %d bytes", c.wrapper.entry.key, c.size, limit)
+			this.removeEntry(c.wrapper)
+			used -= c.size
+		}
+		c.wrapper.Unlock()
+	}
+
+	if used > limit {
+		log.Warningf("Disk cache is %d bytes over its limit but all remaining objects are in use or uploading", used - limit)
+	}
+}
+
+// expireUploads removes the parts of abandoned multipart uploads and returns
+// the space taken up by everything else below the uploads directory.
+func (this *S3Cache) expireUploads() int64 {
+	dir := path.Join(this.cacheDir, UPLOADS_DIR)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	var used int64
+	for _, info := range infos {
+		file := path.Join(dir, info.Name())
+		if info.IsDir() && time.Since(info.ModTime()) > UPLOAD_TTL {
+			log.Infof("Removing parts of abandoned upload %s", file)
+			os.RemoveAll(file)
+			continue
+		}
+
+		filepath.Walk(file, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				used += info.Size()
+			}
+			return nil
+		})
+	}
+	return used
+}
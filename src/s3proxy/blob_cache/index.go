@@ -0,0 +1,148 @@
+package blob_cache
+
+import (
+	"encoding/json"
+	"path"
+	"s3proxy/source"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The index holds the meta of every cached object, so that the cache can be
+// recovered at startup without walking the cache directory.
+const INDEX_FILE = "index.db"
+
+var metaBucket = []byte("meta")
+var infoBucket = []byte("info")
+var importedKey = []byte("imported")
+
+// A nil index persists nothing, but the cache still works without one.
+type metaIndex struct {
+	db *bolt.DB
+}
+
+// bolt holds an exclusive lock on its file, so each cache directory's index
+// can only be open once at a time.
+func openIndex(cacheDir string) (*metaIndex, error) {
+	db, err := bolt.Open(path.Join(cacheDir, INDEX_FILE), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(infoBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &metaIndex{db}, nil
+}
+
+func (this *metaIndex) close() error {
+	if this == nil {
+		return nil
+	}
+	return this.db.Close()
+}
+
+func (this *metaIndex) put(meta *source.Meta) error {
+	if this == nil {
+		return nil
+	}
+
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(meta.Key), metaJson)
+	})
+}
+
+func (this *metaIndex) remove(key string) error {
+	if this == nil {
+		return nil
+	}
+
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Delete([]byte(key))
+	})
+}
+
+// get returns nil if the key isn't in the index.
+func (this *metaIndex) get(key string) (*source.Meta, error) {
+	if this == nil {
+		return nil, nil
+	}
+
+	var meta *source.Meta
+	err := this.db.View(func(tx *bolt.Tx) error {
+		metaJson := tx.Bucket(metaBucket).Get([]byte(key))
+		if metaJson == nil {
+			return nil
+		}
+		meta = &source.Meta{}
+		return json.Unmarshal(metaJson, meta)
+	})
+	return meta, err
+}
+
+// all returns every meta in the index. Entries which can't be decoded are
+// removed.
+func (this *metaIndex) all() ([]*source.Meta, error) {
+	if this == nil {
+		return nil, nil
+	}
+
+	var metas []*source.Meta
+	var broken [][]byte
+	err := this.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).ForEach(func(k, v []byte) error {
+			meta := &source.Meta{}
+			if err := json.Unmarshal(v, meta); err != nil {
+				log.Errorf("Unable to unmarshal meta for %s - %s", k, err)
+				broken = append(broken, append([]byte{}, k...))
+				return nil
+			}
+			metas = append(metas, meta)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range broken {
+		this.remove(string(k))
+	}
+	return metas, nil
+}
+
+// imported reports whether the meta files of older versions have already
+// been imported.
+func (this *metaIndex) imported() bool {
+	if this == nil {
+		return true
+	}
+
+	var imported bool
+	this.db.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(infoBucket).Get(importedKey) != nil
+		return nil
+	})
+	return imported
+}
+
+func (this *metaIndex) markImported() error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(infoBucket).Put(importedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
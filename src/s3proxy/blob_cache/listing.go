@@ -0,0 +1,134 @@
+package blob_cache
+
+import (
+	"fmt"
+	"s3proxy/context"
+	"s3proxy/source"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"golang.org/x/net/context"
+)
+
+// How long listings are cached for
+const LISTING_TTL = time.Minute
+
+// A cachedListing is a single page of a bucket listing. Its lock is held
+// while the page is fetched, so that concurrent requests for the same page
+// share a single upstream request.
+type cachedListing struct {
+	sync.Mutex
+	bucket  string
+	prefix  string
+	listing *source.ObjectListing
+
+	// UnixNano, read without the lock so that old listings can be dropped
+	// without waiting for one being fetched
+	expires int64
+}
+
+func (this *cachedListing) expiry() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&this.expires))
+}
+
+// SetListingTTL sets how long listings are cached for. A TTL of 0 disables
+// caching them.
+func (this *S3Cache) SetListingTTL(ttl time.Duration) {
+	this.listingTTL = ttl
+}
+
+func listingKey(bucket string, opts *source.ListOptions) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%t\x00%s", bucket, opts.Prefix, opts.Delimiter,
+		opts.ContinuationToken, opts.StartAfter, opts.MaxKeys, opts.Versions, opts.VersionIdMarker)
+}
+
+func (this *S3Cache) getOrCreateListing(key, bucket string, opts *source.ListOptions) *cachedListing {
+	this.listingLock.Lock()
+	defer this.listingLock.Unlock()
+
+	cl, ok := this.listings[key]
+	if !ok {
+		// Drop anything which is too old to even be served stale
+		for k, old := range this.listings {
+			if atomic.LoadInt64(&old.expires) != 0 && !this.withinGrace(old.expiry()) {
+				delete(this.listings, k)
+			}
+		}
+
+		cl = &cachedListing{bucket: bucket, prefix: opts.Prefix}
+		this.listings[key] = cl
+	}
+	return cl
+}
+
+// dropListing forgets a listing, unless it has already been replaced.
+func (this *S3Cache) dropListing(key string, cl *cachedListing) {
+	this.listingLock.Lock()
+	defer this.listingLock.Unlock()
+
+	if this.listings[key] == cl {
+		delete(this.listings, key)
+	}
+}
+
+// cachedList returns a listing from the cache, fetching it if it has expired.
+// If the upstream can't be reached, expired listings are served stale for up
+// to the grace period.
+func (this *S3Cache) cachedList(ctx context.Context, bucket string, opts *source.ListOptions) (*source.ObjectListing, error) {
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+
+	key := listingKey(bucket, opts)
+	cl := this.getOrCreateListing(key, bucket, opts)
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.listing != nil && cl.expiry().After(time.Now()) {
+		log.Debugf("Listing cache hit: %s '%s'", bucket, opts.Prefix)
+		return cl.listing, nil
+	}
+
+	log.Debugf("Listing cache miss: %s '%s'", bucket, opts.Prefix)
+	listing, err := this.source.List(bucket, opts)
+	if err != nil {
+		if cl.listing != nil && this.withinGrace(cl.expiry()) {
+			log.Infof("[%d] Unable to list %s '%s', serving stale: %s", ctxValue.Sequence, bucket, opts.Prefix, err)
+			ctxValue.Stale = true
+			return cl.listing, nil
+		}
+
+		// Only listings which were fetched at least once are swept once
+		// they expire
+		if cl.listing == nil {
+			this.dropListing(key, cl)
+		}
+		return nil, err
+	}
+
+	cl.listing = listing
+	atomic.StoreInt64(&cl.expires, time.Now().Add(this.listingTTL).UnixNano())
+	return listing, nil
+}
+
+// invalidateListings drops the cached listings which might include an object.
+func (this *S3Cache) invalidateListings(uri string) {
+	objectUri, _ := source.SplitVersion(uri)
+	bucket, key := splitUri(objectUri)
+
+	this.listingLock.Lock()
+	defer this.listingLock.Unlock()
+
+	for k, cl := range this.listings {
+		if cl.bucket == bucket && (strings.HasPrefix(key, cl.prefix) || strings.HasPrefix(cl.prefix, key)) {
+			delete(this.listings, k)
+		}
+	}
+}
+
+func splitUri(uri string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
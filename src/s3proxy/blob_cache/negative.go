@@ -0,0 +1,84 @@
+package blob_cache
+
+import (
+	"time"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// How long missing objects are remembered
+const NEGATIVE_TTL = time.Minute
+
+// Expired misses are only swept once there are at least this many, and then
+// again whenever the number of misses has doubled since the last sweep.
+const MISS_SWEEP_SIZE = 1024
+
+// A miss remembers the upstream's answer for an object which doesn't exist,
+// or can't be accessed.
+type miss struct {
+	err     error
+	expires time.Time
+}
+
+// SetNegativeTTL sets how long missing objects are remembered, so that they
+// aren't looked up again on every request. A TTL of 0 disables this. If
+// forbidden is true, objects which can't be accessed are remembered as well.
+func (this *S3Cache) SetNegativeTTL(ttl time.Duration, forbidden bool) {
+	this.negativeTTL = ttl
+	this.cacheForbidden = forbidden
+}
+
+// cachedMiss returns the error the upstream last returned for a missing
+// object, or nil.
+func (this *S3Cache) cachedMiss(uri string) error {
+	this.metaLock.Lock()
+	defer this.metaLock.Unlock()
+
+	m, ok := this.misses[uri]
+	if !ok {
+		return nil
+	}
+	if m.expires.Before(time.Now()) {
+		delete(this.misses, uri)
+		return nil
+	}
+	return m.err
+}
+
+// recordMiss remembers an upstream error, if it means the object is missing.
+func (this *S3Cache) recordMiss(uri string, err error) {
+	if this.negativeTTL <= 0 || !this.isMissing(err) {
+		return
+	}
+
+	this.metaLock.Lock()
+	defer this.metaLock.Unlock()
+
+	now := time.Now()
+	if len(this.misses) >= this.missSweepAt {
+		for key, m := range this.misses {
+			if m.expires.Before(now) {
+				delete(this.misses, key)
+			}
+		}
+		this.missSweepAt = 2 * len(this.misses)
+		if this.missSweepAt < MISS_SWEEP_SIZE {
+			this.missSweepAt = MISS_SWEEP_SIZE
+		}
+	}
+	this.misses[uri] = &miss{err, now.Add(this.negativeTTL)}
+}
+
+func (this *S3Cache) isMissing(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch awsErr.Code() {
+	case "NotFound", "NoSuchKey", "NoSuchBucket", "NoSuchVersion":
+		return true
+	case "Forbidden", "AccessDenied":
+		return this.cacheForbidden
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package blob_cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+	"gopkg.in/yaml.v2"
+)
+
+// How expired objects are revalidated
+const (
+	REVALIDATE_BACKGROUND = "background"
+	REVALIDATE_INLINE     = "inline"
+	REVALIDATE_NEVER      = "never"
+)
+
+// A Policy decides how a single object is cached.
+type Policy struct {
+	TTL        time.Duration
+	NoCache    bool
+	// Larger objects are served but not kept. 0 means no limit.
+	MaxSize    int64
+	NoMemory   bool
+	Revalidate string
+	// Expired copies are never served without being revalidated
+	MustRevalidate bool
+}
+
+// A PolicyRule applies to the objects in the buckets matching Bucket, with
+// keys starting with Prefix and matching Match. Bucket and Match are globs,
+// as understood by path.Match, and an empty one matches everything. Fields
+// which are left out fall back to the defaults.
+type PolicyRule struct {
+	Bucket     string `yaml:"bucket"`
+	Prefix     string `yaml:"prefix"`
+	Match      string `yaml:"match"`
+	// In seconds
+	TTL        *int   `yaml:"ttl"`
+	Cache      *bool  `yaml:"cache"`
+	MaxSize    int64  `yaml:"max_size"`
+	Memory     *bool  `yaml:"memory"`
+	Revalidate string `yaml:"revalidate"`
+}
+
+// A PolicyTable is an ordered list of rules. The first rule matching an
+// object decides its policy.
+type PolicyTable struct {
+	Rules []PolicyRule `yaml:"policies"`
+}
+
+// LoadPolicies reads a policy table from a YAML file.
+func LoadPolicies(file string) (*PolicyTable, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &PolicyTable{}
+	err = yaml.Unmarshal(data, table)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range table.Rules {
+		if _, err := path.Match(rule.Bucket, ""); err != nil {
+			return nil, fmt.Errorf("policy %d: invalid bucket '%s'", i + 1, rule.Bucket)
+		}
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return nil, fmt.Errorf("policy %d: invalid match '%s'", i + 1, rule.Match)
+		}
+		switch rule.Revalidate {
+		case "", REVALIDATE_BACKGROUND, REVALIDATE_INLINE, REVALIDATE_NEVER:
+		default:
+			return nil, fmt.Errorf("policy %d: invalid revalidate '%s'", i + 1, rule.Revalidate)
+		}
+	}
+
+	return table, nil
+}
+
+func (this *PolicyRule) matches(bucket, key string) bool {
+	if this.Bucket != "" {
+		if ok, _ := path.Match(this.Bucket, bucket); !ok {
+			return false
+		}
+	}
+	if !strings.HasPrefix(key, this.Prefix) {
+		return false
+	}
+	if this.Match != "" {
+		if ok, _ := path.Match(this.Match, key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *PolicyTable) match(bucket, key string) *PolicyRule {
+	if this == nil {
+		return nil
+	}
+	for i := range this.Rules {
+		if this.Rules[i].matches(bucket, key) {
+			return &this.Rules[i]
+		}
+	}
+	return nil
+}
+
+// SetPolicies sets the table consulted for every request. Objects which
+// don't match any rule are cached according to the defaults.
+func (this *S3Cache) SetPolicies(table *PolicyTable) {
+	this.policyLock.Lock()
+	this.policies = table
+	this.policyLock.Unlock()
+}
+
+// policyFor decides how an object is cached.
+func (this *S3Cache) policyFor(uri string) Policy {
+	policy := Policy{
+		TTL: time.Duration(this.ttl) * time.Second,
+		Revalidate: REVALIDATE_BACKGROUND,
+	}
+
+	this.policyLock.RLock()
+	table := this.policies
+	this.policyLock.RUnlock()
+
+	bucket, key := splitUri(uri)
+	rule := table.match(bucket, key)
+	if rule == nil {
+		return policy
+	}
+
+	if rule.TTL != nil {
+		policy.TTL = time.Duration(*rule.TTL) * time.Second
+	}
+	if rule.Cache != nil {
+		policy.NoCache = !*rule.Cache
+	}
+	policy.MaxSize = rule.MaxSize
+	if rule.Memory != nil {
+		policy.NoMemory = !*rule.Memory
+	}
+	if rule.Revalidate != "" {
+		policy.Revalidate = rule.Revalidate
+	}
+	return policy
+}
+
+// How often transient entries are checked for readers
+const TRANSIENT_POLL = 100 * time.Millisecond
+
+// dropWhenUnused removes a transient entry once nobody is reading it any more.
+func (this *S3Cache) dropWhenUnused(wrapper *cacheEntryWrapper, entry *cacheEntry) {
+	for {
+		time.Sleep(TRANSIENT_POLL)
+
+		wrapper.Lock()
+		if wrapper.entry != entry {
+			wrapper.Unlock()
+			return
+		}
+		if !entry.faultingFile.InUse() {
+			log.Debugf("Dropping uncached %s", entry.key)
+			this.removeEntry(wrapper)
+			wrapper.Unlock()
+			return
+		}
+		wrapper.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package blob_cache
+
+import (
+	"sync/atomic"
+	"time"
+	"s3proxy/source"
+)
+
+// How long after expiring an object is served while it is revalidated in the
+// background
+const REVALIDATE_WINDOW = time.Minute
+
+// SetRevalidateWindow sets how long after expiring an object is still served
+// straight away while it is revalidated in the background. Once the window
+// has passed, requests wait for the object to be revalidated. A window of 0
+// always revalidates inline.
+func (this *S3Cache) SetRevalidateWindow(window time.Duration) {
+	this.revalidateWindow = window
+}
+
+// revalidateAsync revalidates an entry in the background, unless that is
+// already happening. The entry's lock isn't held while the upstream is
+// checked, so readers are never held up.
+func (this *S3Cache) revalidateAsync(sequence uint64, wrapper *cacheEntryWrapper, entry *cacheEntry) {
+	if !atomic.CompareAndSwapInt32(&wrapper.revalidating, 0, 1) {
+		return
+	}
+
+	log.Debugf("[%d] Revalidating %s in the background", sequence, entry.key)
+	go func() {
+		defer atomic.StoreInt32(&wrapper.revalidating, 0)
+
+		meta, err := this.source.GetMeta(entry.key)
+
+		wrapper.Lock()
+		defer wrapper.Unlock()
+
+		// The entry may have been replaced or removed in the meantime
+		if wrapper.entry != entry {
+			return
+		}
+		this.revalidated(sequence, wrapper, meta, err)
+	}()
+}
+
+// revalidated updates an entry with the upstream's current meta, or the error
+// from fetching it. It returns true if the entry should be served stale. Must
+// be called with the wrapper's lock held.
+func (this *S3Cache) revalidated(sequence uint64, wrapper *cacheEntryWrapper, meta *source.Meta, err error) (bool, error) {
+	uri := wrapper.entry.key
+
+	if err != nil {
+		if isNotFound(err) {
+			log.Infof("[%d] Upstream not found for %s", sequence, uri)
+			this.removeEntry(wrapper)
+			return false, nil
+		}
+
+		if this.withinGrace(wrapper.entry.meta.Expires) && !this.objectPolicy(uri, wrapper.entry.meta).MustRevalidate {
+			log.Infof("[%d] Unable to revalidate %s, serving stale: %s", sequence, uri, err)
+			return true, nil
+		}
+
+		log.Errorf("[%d] Unable to revalidate %s: %s", sequence, uri, err)
+		return false, err
+	}
+
+	// Check the ETag, Size and LastModified
+	if meta.ETag == wrapper.entry.meta.ETag &&
+			meta.Size == wrapper.entry.meta.Size &&
+			meta.LastModified == wrapper.entry.meta.LastModified {
+		// Metas are handed out without holding the lock, so never change
+		// them in place. The object's Cache-Control and headers may have
+		// changed.
+		revalidated := *wrapper.entry.meta
+		revalidated.CacheControl = meta.CacheControl
+		revalidated.UpstreamExpires = meta.UpstreamExpires
+		revalidated.ObjectHeaders = meta.ObjectHeaders
+		revalidated.Validated = time.Now()
+		revalidated.Expires = revalidated.Validated.Add(this.objectPolicy(uri, &revalidated).TTL)
+		wrapper.entry.meta = &revalidated
+		this.reindex(&revalidated)
+		log.Infof("[%d] Revalidated %s", sequence, uri)
+		return false, nil
+	}
+
+	// If there is a change, then remove the currently cached entry
+	log.Debugf("[%d] Expiring %s", sequence, uri)
+	this.removeEntry(wrapper)
+	return false, nil
+}
+
+// reindex saves what revalidating an object may have changed to the index.
+// Checkpoints stop once an object is complete, so would never save it, and
+// the download progress they record is left alone.
+func (this *S3Cache) reindex(meta *source.Meta) {
+	indexed, err := this.index.get(meta.Key)
+	if err == nil && indexed != nil {
+		indexed.CacheControl = meta.CacheControl
+		indexed.UpstreamExpires = meta.UpstreamExpires
+		indexed.ObjectHeaders = meta.ObjectHeaders
+		indexed.Validated = meta.Validated
+		indexed.Expires = meta.Expires
+		err = this.index.put(indexed)
+	}
+	if err != nil {
+		log.Errorf("ERROR saving meta for %s: %s", meta.Key, err)
+	}
+}
@@ -0,0 +1,70 @@
+package blob_cache
+
+import (
+	"time"
+	"golang.org/x/net/context"
+)
+
+// StartScrubber re-verifies the whole disk cache every interval, reading at
+// no more than bytesPerSecond.
+func (this *S3Cache) StartScrubber(bytesPerSecond int64, interval time.Duration) {
+	go func() {
+		for {
+			this.Scrub(bytesPerSecond)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Scrub checks every block on disk against its checksum. Corrupt blocks are
+// fetched again; objects which can't be re-fetched are evicted. A rate of 0
+// means no limit.
+func (this *S3Cache) Scrub(bytesPerSecond int64) {
+	throttle := func(n int) {
+		if bytesPerSecond > 0 {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(bytesPerSecond))
+		}
+	}
+
+	for _, wrapper := range this.wrappers() {
+		wrapper.RLock()
+		entry := wrapper.entry
+		wrapper.RUnlock()
+
+		if entry == nil {
+			continue
+		}
+
+		corrupt := entry.faultingFile.Scrub(throttle)
+		if len(corrupt) == 0 {
+			continue
+		}
+
+		if this.refetch(entry, corrupt) {
+			log.Infof("Re-fetched %d corrupt blocks of %s", len(corrupt), entry.key)
+			continue
+		}
+
+		wrapper.Lock()
+		if wrapper.entry == entry && !entry.faultingFile.InUse() {
+			log.Infof("Evicting corrupt object %s", entry.key)
+			this.removeEntry(wrapper)
+		}
+		wrapper.Unlock()
+	}
+}
+
+func (this *S3Cache) refetch(entry *cacheEntry, blocks []int) bool {
+	if entry.faultingFile.Fetcher == nil {
+		return false
+	}
+
+	for _, i := range blocks {
+		_, err := entry.faultingFile.GetBlock(context.Background(), i)
+		if err != nil {
+			log.Errorf("Unable to re-fetch block %d of %s: %s", i, entry.key, err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package blob_cache
+
+import (
+	"errors"
+	"s3proxy/source"
+	"sort"
+	"strings"
+	"time"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// How long an expired object is still served while the upstream can't be
+// reached
+const STALE_GRACE = time.Hour
+
+// ErrOffline is returned for anything which isn't cached while offline.
+var ErrOffline = errors.New("not cached and the upstream is offline")
+
+// SetStaleGrace sets how long after expiring an object is still served when
+// it can't be revalidated because the upstream is unreachable.
+func (this *S3Cache) SetStaleGrace(grace time.Duration) {
+	this.staleGrace = grace
+}
+
+// SetOffline stops the cache from ever contacting the upstream. Only complete
+// objects already on disk are served, however long ago they expired. Must be
+// called before any objects are added.
+func (this *S3Cache) SetOffline(offline bool) {
+	this.offline = offline
+}
+
+func (this *S3Cache) withinGrace(expires time.Time) bool {
+	return time.Now().Before(expires.Add(this.staleGrace))
+}
+
+func isNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "NotFound"
+}
+
+// cachedObjects returns the complete objects cached under a prefix, sorted by
+// key. Keys are relative to the prefix. Versions of objects aren't included.
+func (this *S3Cache) cachedObjects(prefix string) []source.ObjectInfo {
+	var objects []source.ObjectInfo
+	for _, wrapper := range this.wrappers() {
+		wrapper.RLock()
+		entry := wrapper.entry
+		if entry != nil && strings.HasPrefix(entry.key, prefix) && entry.faultingFile.Complete() &&
+				!strings.Contains(entry.key, source.VERSION_SEPARATOR) {
+			objects = append(objects, source.ObjectInfo{
+				Key: strings.TrimPrefix(entry.key, prefix),
+				Size: entry.meta.Size,
+				ETag: entry.meta.ETag,
+				LastModified: entry.meta.LastModified,
+			})
+		}
+		wrapper.RUnlock()
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects
+}
+
+// offlineList lists a bucket from what is cached. Continuation tokens are
+// simply the last key or prefix returned.
+func (this *S3Cache) offlineList(bucket string, opts *source.ListOptions) *source.ObjectListing {
+	marker := opts.StartAfter
+	if opts.ContinuationToken > marker {
+		marker = opts.ContinuationToken
+	}
+
+	maxKeys := int(opts.MaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	listing := &source.ObjectListing{}
+	last := ""
+	count := 0
+	for _, obj := range this.cachedObjects("/" + bucket + "/") {
+		if !strings.HasPrefix(obj.Key, opts.Prefix) {
+			continue
+		}
+
+		// Keys are sorted, so all the keys sharing a prefix are together
+		item := obj.Key
+		isPrefix := false
+		if opts.Delimiter != "" {
+			if idx := strings.Index(obj.Key[len(opts.Prefix):], opts.Delimiter); idx >= 0 {
+				item = obj.Key[:len(opts.Prefix) + idx + len(opts.Delimiter)]
+				isPrefix = true
+			}
+		}
+		if item <= marker || item == last {
+			continue
+		}
+
+		if count == maxKeys {
+			listing.IsTruncated = true
+			listing.NextContinuationToken = last
+			break
+		}
+
+		if isPrefix {
+			listing.CommonPrefixes = append(listing.CommonPrefixes, item)
+		} else {
+			listing.Objects = append(listing.Objects, obj)
+		}
+		last = item
+		count++
+	}
+
+	return listing
+}
+
+// offlineBuckets returns the buckets which have anything cached.
+func (this *S3Cache) offlineBuckets() []source.BucketInfo {
+	seen := make(map[string]bool)
+	var buckets []source.BucketInfo
+	for _, obj := range this.cachedObjects("/") {
+		name := strings.SplitN(obj.Key, "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			buckets = append(buckets, source.BucketInfo{Name: name})
+		}
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	return buckets
+}
@@ -0,0 +1,352 @@
+package blob_cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"s3proxy/context"
+	"s3proxy/source"
+	"strings"
+	"time"
+	"golang.org/x/net/context"
+)
+
+// Uploads are spooled to disk below this directory before they are sent
+// upstream. Underscores aren't allowed in bucket names, so it can't clash with
+// the old layout of bucket directories.
+const UPLOADS_DIR = "_uploads"
+
+// Put writes an object through to the upstream. The content is spooled to
+// disk as it arrives, sent upstream from there and then becomes the cached
+// copy of the object, so that the first read afterwards is a hit.
+func (this *S3Cache) Put(ctx context.Context, uri string, body io.Reader, meta *source.Meta, opts *source.UploadOptions) (*source.Meta, error) {
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+
+	if this.offline {
+		return nil, ErrOffline
+	}
+
+	spooled, size, err := this.spool(body)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spooled.Name())
+	defer spooled.Close()
+
+	meta.Size = size
+	stored, err := this.source.Put(uri, spooled, meta, opts)
+	if err != nil {
+		log.Errorf("[%d] Unable to put %s: %s", ctxValue.Sequence, uri, err)
+		return nil, err
+	}
+
+	log.Infof("[%d] Put %s (%d bytes)", ctxValue.Sequence, uri, size)
+	this.written(ctxValue.Sequence, uri, spooled.Name(), stored)
+	return stored, nil
+}
+
+func (this *S3Cache) CreateMultipartUpload(ctx context.Context, uri string, meta *source.Meta, opts *source.UploadOptions) (string, error) {
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+
+	if this.offline {
+		return "", ErrOffline
+	}
+
+	uploadId, err := this.source.CreateMultipartUpload(uri, meta, opts)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("[%d] Started upload %s of %s", ctxValue.Sequence, uploadId, uri)
+	return uploadId, nil
+}
+
+// UploadPart sends a part of a multipart upload upstream. Parts are kept on
+// disk, by number and ETag, until the upload is completed.
+func (this *S3Cache) UploadPart(ctx context.Context, uri, uploadId string, partNumber int64, body io.Reader, opts *source.UploadOptions) (string, error) {
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+
+	if this.offline {
+		return "", ErrOffline
+	}
+
+	spooled, _, err := this.spool(body)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(spooled.Name())
+	defer spooled.Close()
+
+	etag, err := this.source.UploadPart(uri, uploadId, partNumber, spooled, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// Without the part the upload simply isn't cached
+	partFile := this.partFile(uploadId, partNumber, etag)
+	err = os.MkdirAll(path.Dir(partFile), 0755)
+	if err == nil {
+		err = os.Rename(spooled.Name(), partFile)
+	}
+	if err != nil {
+		log.Errorf("[%d] Unable to keep part %d of %s: %s", ctxValue.Sequence, partNumber, uri, err)
+	}
+
+	go this.EnforceDiskLimit()
+	return etag, nil
+}
+
+// CompleteMultipartUpload completes an upload upstream and then joins the
+// parts to become the cached copy of the object.
+func (this *S3Cache) CompleteMultipartUpload(ctx context.Context, uri, uploadId string, parts []source.CompletedPart, opts *source.UploadOptions) (*source.Meta, error) {
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+
+	if this.offline {
+		return nil, ErrOffline
+	}
+
+	stored, err := this.source.CompleteMultipartUpload(uri, uploadId, parts, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(this.uploadDir(uploadId))
+
+	log.Infof("[%d] Completed upload %s of %s", ctxValue.Sequence, uploadId, uri)
+
+	joined, err := this.join(uploadId, parts)
+	if err != nil {
+		log.Infof("[%d] Not caching upload %s of %s: %s", ctxValue.Sequence, uploadId, uri, err)
+		this.written(ctxValue.Sequence, uri, "", stored)
+		return stored, nil
+	}
+	defer os.Remove(joined)
+
+	this.written(ctxValue.Sequence, uri, joined, stored)
+	return stored, nil
+}
+
+func (this *S3Cache) AbortMultipartUpload(ctx context.Context, uri, uploadId string) error {
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+
+	if this.offline {
+		return ErrOffline
+	}
+
+	defer os.RemoveAll(this.uploadDir(uploadId))
+
+	log.Infof("[%d] Aborting upload %s of %s", ctxValue.Sequence, uploadId, uri)
+	return this.source.AbortMultipartUpload(uri, uploadId)
+}
+
+// written replaces whatever is cached for an object which has just been
+// written upstream with the file it was written from. Without a file, or if
+// the object shouldn't be cached, anything cached for it is simply dropped.
+func (this *S3Cache) written(sequence uint64, uri string, file string, meta *source.Meta) {
+	// What is cached has to match what later revalidations will see, so the
+	// meta is read back. If it can't be, the object isn't cached.
+	if file != "" {
+		readBack, err := this.source.GetMeta(source.VersionedUri(uri, meta.VersionId))
+		if err == nil && readBack.ETag != meta.ETag {
+			err = fmt.Errorf("ETag %s instead of %s", readBack.ETag, meta.ETag)
+		}
+		if err != nil {
+			log.Infof("[%d] Not caching %s: unable to read it back: %s", sequence, uri, err)
+			file = ""
+		} else {
+			meta = readBack
+		}
+	}
+
+	this.metaLock.Lock()
+	delete(this.cachedMetas, uri)
+	delete(this.misses, uri)
+	this.metaLock.Unlock()
+
+	this.invalidateListings(uri)
+
+	policy := this.objectPolicy(uri, meta)
+	cacheable := file != "" && !policy.NoCache && (policy.MaxSize == 0 || meta.Size <= policy.MaxSize)
+	if cacheable {
+		info, err := os.Stat(file)
+		cacheable = err == nil && info.Size() == meta.Size
+	}
+
+	wrapper := this.getOrCreateWrapper(uri)
+	wrapper.Lock()
+
+	if wrapper.entry != nil && wrapper.entry.faultingFile.InUse() {
+		// Without moving the old file out of the way, its readers would be
+		// handed the new object
+		if !this.retireEntry(sequence, wrapper) {
+			cacheable = false
+		}
+	} else if wrapper.entry != nil {
+		this.removeEntry(wrapper)
+	}
+
+	if !cacheable {
+		wrapper.Unlock()
+		return
+	}
+
+	// The data has to be on disk before the index says it is complete
+	dst := source.CachePath(this.cacheDir, uri)
+	err := syncFile(file)
+	if err == nil {
+		err = os.MkdirAll(path.Dir(dst), 0755)
+	}
+	if err == nil {
+		err = os.Rename(file, dst)
+	}
+	if err != nil {
+		wrapper.Unlock()
+		log.Errorf("[%d] Unable to cache %s: %s", sequence, uri, err)
+		return
+	}
+
+	meta.Complete = true
+	meta.Validated = time.Now()
+	meta.Expires = meta.Validated.Add(policy.TTL)
+	entry := this.diskEntry(meta, uri)
+	if entry == nil {
+		os.Remove(dst)
+		wrapper.Unlock()
+		return
+	}
+
+	wrapper.entry = entry
+	err = this.index.put(meta)
+	if err != nil {
+		log.Errorf("[%d] Unable to index %s: %s", sequence, uri, err)
+	}
+	wrapper.Unlock()
+
+	log.Debugf("[%d] Cached %s as written", sequence, uri)
+	entry.faultingFile.SetCheckpoint(this.checkpointer(wrapper, entry.faultingFile))
+
+	// Make room for the new object in the background
+	go this.EnforceDiskLimit()
+}
+
+// retireEntry takes an entry which is still being read out of the cache. Its
+// file is moved below the uploads directory, so that the object's path can be
+// reused, and removed once nobody is reading it any more. If it can't be
+// moved, it is removed straight away and false is returned. Must be called
+// with the wrapper's lock held.
+func (this *S3Cache) retireEntry(sequence uint64, wrapper *cacheEntryWrapper) bool {
+	entry := wrapper.entry
+	ff := entry.faultingFile
+
+	dir := path.Join(this.cacheDir, UPLOADS_DIR)
+	err := os.MkdirAll(dir, 0755)
+	var retired *os.File
+	if err == nil {
+		retired, err = ioutil.TempFile(dir, "retired-")
+	}
+	if err == nil {
+		retired.Close()
+		err = ff.Relocate(retired.Name())
+	}
+	if err != nil {
+		log.Errorf("[%d] Unable to retire %s, removing it: %s", sequence, entry.key, err)
+		if retired != nil {
+			os.Remove(retired.Name())
+		}
+		this.removeEntry(wrapper)
+		return false
+	}
+
+	log.Debugf("[%d] Retiring %s until it is no longer read", sequence, entry.key)
+	this.index.remove(entry.key)
+	this.blockCache.DeleteAll(entry.key)
+	wrapper.entry = nil
+
+	go func() {
+		for ff.InUse() {
+			time.Sleep(TRANSIENT_POLL)
+		}
+		os.Remove(retired.Name())
+	}()
+	return true
+}
+
+// spool writes an upload to a temporary file, returning it ready to be read
+// from the start.
+func (this *S3Cache) spool(body io.Reader) (*os.File, int64, error) {
+	dir := path.Join(this.cacheDir, UPLOADS_DIR)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err := ioutil.TempFile(dir, "spool-")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := io.Copy(f, body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// join concatenates the parts of an upload, returning the joined file.
+func (this *S3Cache) join(uploadId string, parts []source.CompletedPart) (string, error) {
+	f, err := ioutil.TempFile(path.Join(this.cacheDir, UPLOADS_DIR), "joined-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, part := range parts {
+		err = appendFile(f, this.partFile(uploadId, part.PartNumber, part.ETag))
+		if err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	return f.Name(), nil
+}
+
+func syncFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func appendFile(dst io.Writer, file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// Upload ids are chosen by the upstream, so they are hashed to be safe to use
+// as a directory name.
+func (this *S3Cache) uploadDir(uploadId string) string {
+	sum := sha256.Sum256([]byte(uploadId))
+	return path.Join(this.cacheDir, UPLOADS_DIR, hex.EncodeToString(sum[:]))
+}
+
+// Clients don't always quote the ETags of parts when completing an upload.
+func (this *S3Cache) partFile(uploadId string, partNumber int64, etag string) string {
+	sum := sha256.Sum256([]byte(strings.Trim(etag, "\"")))
+	return path.Join(this.uploadDir(uploadId), fmt.Sprintf("%d-%s", partNumber, hex.EncodeToString(sum[:8])))
+}
@@ -5,6 +5,7 @@ import (
 	"s3proxy/proxy"
 	"s3proxy/source"
 	"s3proxy/blob_cache"
+	"s3proxy/faulting"
 	"github.com/karlseguin/ccache"
 	"flag"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"strings"
 	"github.com/go-zoo/bone"
+	"time"
 	_ "net/http/pprof"
 )
 
@@ -23,6 +25,22 @@ type Config struct {
 	cacheDir  string
 	region    string
 	ttl       int
+	apiPort   int
+	apiDomain string
+	diskSize  int64
+	diskPct   int
+	retries   int
+	backoff   int
+	scrubRate int64
+	scrubDays int
+	grace     int
+	offline   bool
+	window    int
+	negTtl    int
+	forbidden bool
+	listTtl   int
+	policies  string
+	writes    bool
 }
 
 func init() {
@@ -39,22 +57,53 @@ func main() {
 
 	cache := ccache.Layered(ccache.Configure().MaxSize(config.cacheSize).ItemsToPrune(100))
 	s := source.NewS3Source(cache, config.region, config.cacheDir)
+	s.SetRetries(config.retries, time.Duration(config.backoff) * time.Millisecond)
 	c := blob_cache.NewS3Cache(cache, *s, config.cacheDir, config.ttl)
+	c.SetDiskLimit(config.diskSize * 1024 * 1024, config.diskPct)
+	c.SetStaleGrace(time.Duration(config.grace) * time.Second)
+	c.SetRevalidateWindow(time.Duration(config.window) * time.Second)
+	c.SetNegativeTTL(time.Duration(config.negTtl) * time.Second, config.forbidden)
+	c.SetListingTTL(time.Duration(config.listTtl) * time.Second)
+
+	if config.policies != "" {
+		policies, err := blob_cache.LoadPolicies(config.policies)
+		if err != nil {
+			log.Fatalf("Unable to load policies from %s: %v", config.policies, err)
+		}
+		c.SetPolicies(policies)
+	}
+	c.SetOffline(config.offline)
 
 	log.Info("Scanning for meta files")
 	c.RecoverMeta()
+	c.EnforceDiskLimit()
+
+	if config.scrubRate > 0 {
+		c.StartScrubber(config.scrubRate * 1024 * 1024, time.Duration(config.scrubDays) * 24 * time.Hour)
+	}
 
 	pxy := proxy.NewS3Proxy(c)
+	pxy.SetWritable(config.writes)
 
 	m := bone.New()
 
 	m.Delete("/*", http.HandlerFunc(pxy.Delete))
 	m.Get("/*", http.HandlerFunc(pxy.Handler))
+	m.Head("/*", http.HandlerFunc(pxy.Head))
+	m.Put("/*", http.HandlerFunc(pxy.Put))
 
 	go func() {
 		http.ListenAndServe(":6060", nil)
 	}()
 
+	if config.apiPort > 0 {
+		api := proxy.NewS3Api(c, config.apiDomain)
+		api.SetWritable(config.writes)
+		go func() {
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.apiPort), api))
+		}()
+	}
+
 	http.ListenAndServe(fmt.Sprintf(":%d", config.port), m)
 }
 
@@ -70,6 +119,22 @@ func processArgs() *Config {
 	flag.IntVar(&c.port, "p", 8080, "port to listen on")
 	flag.StringVar(&c.region, "r", "us-west-2", "region to use")
 	flag.IntVar(&c.ttl, "t", 600, "time before objects are re-validated (in seconds)")
+	flag.IntVar(&c.apiPort, "a", 0, "port for the S3 compatible API (0 to disable)")
+	flag.StringVar(&c.apiDomain, "d", "", "domain for virtual-hosted-style S3 API requests")
+	flag.Int64Var(&c.diskSize, "s", 0, "max size of the disk cache (in MB, 0 for no limit)")
+	flag.IntVar(&c.diskPct, "f", 0, "max percent of the cache filesystem to use (0 for no limit)")
+	flag.IntVar(&c.retries, "n", faulting.UPSTREAM_RETRIES, "times to resume an interrupted upstream download")
+	flag.IntVar(&c.backoff, "b", int(faulting.RETRY_BACKOFF / time.Millisecond), "initial delay before resuming a download (in ms)")
+	flag.Int64Var(&c.scrubRate, "v", 0, "rate at which the disk cache is re-verified (in MB/s, 0 to disable)")
+	flag.IntVar(&c.scrubDays, "i", 1, "days between re-verifying the disk cache")
+	flag.IntVar(&c.grace, "g", int(blob_cache.STALE_GRACE / time.Second), "time expired objects are still served while S3 is unreachable (in seconds)")
+	flag.IntVar(&c.window, "w", int(blob_cache.REVALIDATE_WINDOW / time.Second), "time expired objects are served while being revalidated in the background (in seconds, 0 to revalidate inline)")
+	flag.IntVar(&c.negTtl, "e", int(blob_cache.NEGATIVE_TTL / time.Second), "time missing objects are remembered (in seconds, 0 to disable)")
+	flag.BoolVar(&c.forbidden, "forbidden", false, "also remember objects which are forbidden")
+	flag.IntVar(&c.listTtl, "l", int(blob_cache.LISTING_TTL / time.Second), "time listings are cached for (in seconds, 0 to disable)")
+	flag.StringVar(&c.policies, "policies", "", "YAML file with per-bucket and prefix cache policies")
+	flag.BoolVar(&c.offline, "offline", false, "never contact S3, only serve what is already cached")
+	flag.BoolVar(&c.writes, "writes", false, "write uploads through to S3 (read-only otherwise)")
 
 	flag.Parse()
 
@@ -90,6 +155,22 @@ func processArgs() *Config {
 	log.Infof("    time-to-live:    %d", c.ttl)
 	log.Infof("    region:          %s", c.region)
 	log.Infof("    cache dir:       %s", c.cacheDir)
+	log.Infof("    disk size (MB):  %d", c.diskSize)
+	log.Infof("    disk percent:    %d", c.diskPct)
+	log.Infof("    S3 API port:     %d", c.apiPort)
+	log.Infof("    S3 API domain:   %s", c.apiDomain)
+	log.Infof("    retries:         %d", c.retries)
+	log.Infof("    backoff (ms):    %d", c.backoff)
+	log.Infof("    scrub (MB/s):    %d", c.scrubRate)
+	log.Infof("    scrub (days):    %d", c.scrubDays)
+	log.Infof("    stale grace:     %d", c.grace)
+	log.Infof("    revalidate (s):  %d", c.window)
+	log.Infof("    negative ttl:    %d", c.negTtl)
+	log.Infof("    forbidden:       %t", c.forbidden)
+	log.Infof("    listing ttl:     %d", c.listTtl)
+	log.Infof("    policies:        %s", c.policies)
+	log.Infof("    offline:         %t", c.offline)
+	log.Infof("    writes:          %t", c.writes)
 
 	return c
 }
@@ -2,5 +2,12 @@ package cache_context
 
 type Context struct {
 	Sequence uint64
+
+	// Set when the response is served from an expired entry which couldn't
+	// be revalidated
+	Stale    bool
+
+	// The request's Cache-Control directives
+	CacheControl string
 }
 
@@ -8,16 +8,67 @@ import (
 	"io"
 	"fmt"
 	"errors"
-	"path"
 	"github.com/karlseguin/ccache"
 	"time"
 	"golang.org/x/net/context"
+	"bytes"
+	"io/ioutil"
+	"crypto/md5"
+	"sync"
+	"sync/atomic"
+	"sort"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 )
 
+// All generated objects claim to have been modified at this time
+var FakeLastModified = time.Date(2017, time.April, 1, 12, 0, 0, 0, time.UTC)
+
+// How long a Get from the 'slow' bucket takes to respond
+var SlowGetDelay = 500 * time.Millisecond
+
+// Returned for every call while the source is unavailable, as the SDK does
+// when S3 can't be reached
+var ErrUnavailable = awserr.New("RequestError", "send request failed", errors.New("connection refused"))
+
 type FakeUpstreamSource struct {
 	baseDir        string
 	cacheBlockSize int
 	blockCache     *ccache.LayeredCache
+
+	// Keys returned by List, per bucket
+	Objects        map[string][]string
+
+	// Cache-Control and Expires set on objects, per uri
+	CacheControl   map[string]string
+	Expires        map[string]time.Time
+
+	// Headers set on objects, per uri
+	Headers        map[string]source.ObjectHeaders
+
+	// Versions of objects, newest first, per uri. Every version has the same
+	// content.
+	Versions       map[string][]string
+
+	// Options of the last upload, or part of one, per uri
+	UploadOptions  map[string]*source.UploadOptions
+
+	// Parts of the last completed multipart upload, per uri
+	CompletedParts map[string][]source.CompletedPart
+
+	// Count the calls made upstream
+	GetCount       int32
+	GetMetaCount   int32
+	ListCount      int32
+	PutCount       int32
+
+	unavailable    int32
+
+	// Objects written with Put or multipart uploads, which are served
+	// instead of generated content
+	lock           sync.Mutex
+	written        map[string][]byte
+	uploads        map[string]map[int64][]byte
+	uploadCount    int
 }
 
 func NewFakeUpstreamSource(baseDir string, cache *ccache.LayeredCache) *FakeUpstreamSource {
@@ -25,20 +76,269 @@ func NewFakeUpstreamSource(baseDir string, cache *ccache.LayeredCache) *FakeUpst
 		baseDir: baseDir,
 		cacheBlockSize: 0,
 		blockCache: cache,
+		Objects: make(map[string][]string),
+		CacheControl: make(map[string]string),
+		Expires: make(map[string]time.Time),
+		Headers: make(map[string]source.ObjectHeaders),
+		Versions: make(map[string][]string),
+		UploadOptions: make(map[string]*source.UploadOptions),
+		CompletedParts: make(map[string][]source.CompletedPart),
+		written: make(map[string][]byte),
+		uploads: make(map[string]map[int64][]byte),
 	}
 }
 
+// SetUnavailable makes every call fail, as if S3 couldn't be reached.
+func (this *FakeUpstreamSource) SetUnavailable(unavailable bool) {
+	var v int32
+	if unavailable {
+		v = 1
+	}
+	atomic.StoreInt32(&this.unavailable, v)
+}
+
+func (this *FakeUpstreamSource) isUnavailable() bool {
+	return atomic.LoadInt32(&this.unavailable) == 1
+}
+
 func (this *FakeUpstreamSource) Get(ctx context.Context, uri string) (*faulting.FaultingFile, *source.Meta, error) {
-	parts := strings.Split(strings.TrimLeft(uri, "/"), "/")
+	atomic.AddInt32(&this.GetCount, 1)
+
+	if this.isUnavailable() {
+		return nil, nil, ErrUnavailable
+	}
+
+	switch {
+	case strings.HasPrefix(uri, "/missing/") && !this.isWritten(uri):
+		return nil, nil, awserr.New("NoSuchKey", "The specified key does not exist.", nil)
+	case strings.HasPrefix(uri, "/forbidden/"):
+		return nil, nil, awserr.New("AccessDenied", "Access Denied", nil)
+	case !this.hasVersion(uri):
+		return nil, nil, awserr.New("NoSuchVersion", "The specified version does not exist.", nil)
+	}
+
+	// Objects in the 'slow' bucket take a while to respond, and then to start
+	// arriving
+	if strings.HasPrefix(uri, "/slow/") {
+		time.Sleep(SlowGetDelay)
+	}
+
+	r, cachedFile := this.generate(uri)
+
+	secondaryCache := this.blockCache.GetOrCreateSecondaryCache(uri)
+	ff, err := faulting.NewFaultingFile(r, cachedFile, r.Size(), secondaryCache)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if this.cacheBlockSize > 0 {
+		ff.SetBlockSize(this.cacheBlockSize)
+	}
+	if rs, ok := r.(RangeSource); ok {
+		ff.Fetcher = rs.GetRange
+	}
+	ff.AddVerifier(faulting.MD5Verifier(r.ETag()))
+	ff.Stream(nil)
+
+	return ff, this.generatedMeta(uri, r), nil
+}
+
+func (this *FakeUpstreamSource) GetMeta(uri string) (*source.Meta, error) {
+	atomic.AddInt32(&this.GetMetaCount, 1)
+
+	if this.isUnavailable() {
+		return nil, ErrUnavailable
+	}
+
+	switch {
+	case strings.HasPrefix(uri, "/slow/"):
+		time.Sleep(SlowGetDelay)
+	case strings.HasPrefix(uri, "/missing/") && !this.isWritten(uri):
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	case strings.HasPrefix(uri, "/forbidden/"), strings.HasPrefix(uri, "/unreadable/"):
+		return nil, awserr.New("Forbidden", "Forbidden", nil)
+	case !this.hasVersion(uri):
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+
+	r, _ := this.generate(uri)
+	return this.generatedMeta(uri, r), nil
+}
+
+// isWritten reports whether an object has been written, which makes even
+// missing objects exist.
+func (this *FakeUpstreamSource) isWritten(uri string) bool {
+	objectUri, _ := source.SplitVersion(uri)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, ok := this.written[objectUri]
+	return ok
+}
+
+// hasVersion reports whether the version in a uri, if any, exists.
+func (this *FakeUpstreamSource) hasVersion(uri string) bool {
+	objectUri, version := source.SplitVersion(uri)
+	if version == "" {
+		return true
+	}
+	for _, v := range this.Versions[objectUri] {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *FakeUpstreamSource) Fetcher(uri, etag string) faulting.RangeFetcher {
+	r, _ := this.generate(uri)
+	rs, ok := r.(RangeSource)
+	if !ok {
+		return nil
+	}
+
+	return func(start, end int64) (io.ReadCloser, error) {
+		if this.isUnavailable() {
+			return nil, ErrUnavailable
+		}
+		if r.ETag() != etag {
+			return nil, faulting.ErrChanged
+		}
+		return rs.GetRange(start, end)
+	}
+}
+
+func (this *FakeUpstreamSource) Directory(dir string) ([]source.DirEntry, error) {
+	return source.ListDirectory(this, dir)
+}
+
+// List pages through the configured Objects. Continuation tokens are simply
+// the index of the next key.
+func (this *FakeUpstreamSource) List(bucket string, opts *source.ListOptions) (*source.ObjectListing, error) {
+	atomic.AddInt32(&this.ListCount, 1)
+
+	if this.isUnavailable() {
+		return nil, ErrUnavailable
+	}
+
+	if bucket == "slow" {
+		time.Sleep(SlowGetDelay)
+	}
+
+	keys, ok := this.Objects[bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "The specified bucket does not exist", nil)
+	}
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+
+	start := 0
+	if opts.ContinuationToken != "" {
+		start, _ = strconv.Atoi(opts.ContinuationToken)
+	}
+
+	maxKeys := int(opts.MaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	listing := &source.ObjectListing{}
+	seenPrefixes := make(map[string]bool)
+	count := 0
+	for i := start; i < len(keys); i++ {
+		key := keys[i]
+		if !strings.HasPrefix(key, opts.Prefix) || key <= opts.StartAfter {
+			continue
+		}
+
+		if count == maxKeys {
+			listing.IsTruncated = true
+			listing.NextContinuationToken = strconv.Itoa(i)
+			break
+		}
+
+		if opts.Delimiter != "" {
+			if idx := strings.Index(key[len(opts.Prefix):], opts.Delimiter); idx >= 0 {
+				prefix := key[:len(opts.Prefix) + idx + len(opts.Delimiter)]
+				if !seenPrefixes[prefix] {
+					seenPrefixes[prefix] = true
+					listing.CommonPrefixes = append(listing.CommonPrefixes, prefix)
+					count++
+				}
+				continue
+			}
+		}
+
+		r, _ := this.generate("/" + bucket + "/" + key)
+		info := source.ObjectInfo{
+			Key: key,
+			Size: r.Size(),
+			ETag: r.ETag(),
+			LastModified: FakeLastModified,
+			StorageClass: "STANDARD",
+		}
+		if !opts.Versions {
+			listing.Objects = append(listing.Objects, info)
+		} else {
+			versions := this.Versions["/" + bucket + "/" + key]
+			if len(versions) == 0 {
+				versions = []string{"null"}
+			}
+			for i, v := range versions {
+				info.VersionId = v
+				info.IsLatest = i == 0
+				listing.Objects = append(listing.Objects, info)
+			}
+		}
+		count++
+	}
+
+	return listing, nil
+}
+
+func (this *FakeUpstreamSource) Buckets() ([]source.BucketInfo, error) {
+	if this.isUnavailable() {
+		return nil, ErrUnavailable
+	}
+
+	var buckets []source.BucketInfo
+	for name := range this.Objects {
+		buckets = append(buckets, source.BucketInfo{
+			Name: name,
+			CreationDate: FakeLastModified,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+
+	return buckets, nil
+}
+
+// generate creates the content for a uri. The last path element is the number
+// of integers to produce and the bucket determines the kind of source.
+func (this *FakeUpstreamSource) generate(uri string) (GeneratedContentReader, string) {
+	objectUri, _ := source.SplitVersion(uri)
+	parts := strings.Split(strings.TrimLeft(objectUri, "/"), "/")
 	size, _ := strconv.Atoi(parts[len(parts) - 1])
 
-	cachedFile := path.Join(this.baseDir, path.Join(parts...))
+	cachedFile := source.CachePath(this.baseDir, uri)
+
+	this.lock.Lock()
+	content, ok := this.written[objectUri]
+	this.lock.Unlock()
+	if ok {
+		return &IntegerSequenceSource{Content: content}, cachedFile
+	}
 
 	var r GeneratedContentReader
 
 	switch parts[0] {
 	case "error":
 		r = NewErroringSource(size)
+	case "corrupt":
+		r = NewCorruptSource(size)
+	case "flaky":
+		r = NewFlakySource(size)
+	case "slow":
+		r = NewSlowSource(size)
 	case "uncached":
 		cachedFile = "/dev/null"
 		r = NewIntegerStreamingSource(size)
@@ -46,34 +346,149 @@ func (this *FakeUpstreamSource) Get(ctx context.Context, uri string) (*faulting.
 		r = NewIntegerStreamingSource(size)
 	}
 
-	secondaryCache := this.blockCache.GetOrCreateSecondaryCache(uri)
-	ff, err := faulting.NewFaultingFile(r, cachedFile, r.Size(), secondaryCache)
+	return r, cachedFile
+}
+
+func (this *FakeUpstreamSource) generatedMeta(uri string, r GeneratedContentReader) *source.Meta {
+	meta := &source.Meta{
+		Size: r.Size(),
+		ETag: r.ETag(),
+		LastModified: FakeLastModified,
+		CacheControl: this.CacheControl[uri],
+		UpstreamExpires: this.Expires[uri],
+		ObjectHeaders: this.Headers[uri],
+	}
+	if _, version := source.SplitVersion(uri); version != "" {
+		meta.VersionId = version
+	}
+	return meta
+}
+
+func (this *FakeUpstreamSource) Put(uri string, body io.ReadSeeker, meta *source.Meta, opts *source.UploadOptions) (*source.Meta, error) {
+	atomic.AddInt32(&this.PutCount, 1)
+	this.recordOptions(uri, opts)
+
+	if this.isUnavailable() {
+		return nil, ErrUnavailable
+	}
+	if strings.HasPrefix(uri, "/forbidden/") {
+		return nil, awserr.New("AccessDenied", "Access Denied", nil)
+	}
+
+	content, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return this.write(uri, content), nil
+}
 
-	if this.cacheBlockSize > 0 {
-		ff.SetBlockSize(this.cacheBlockSize)
+func (this *FakeUpstreamSource) write(uri string, content []byte) *source.Meta {
+	this.lock.Lock()
+	this.written[uri] = content
+	this.lock.Unlock()
+
+	r, _ := this.generate(uri)
+	return this.generatedMeta(uri, r)
+}
+
+func (this *FakeUpstreamSource) recordOptions(uri string, opts *source.UploadOptions) {
+	this.lock.Lock()
+	this.UploadOptions[uri] = opts
+	this.lock.Unlock()
+}
+
+// Upload ids are simply a counter.
+func (this *FakeUpstreamSource) CreateMultipartUpload(uri string, meta *source.Meta, opts *source.UploadOptions) (string, error) {
+	this.recordOptions(uri, opts)
+	if this.isUnavailable() {
+		return "", ErrUnavailable
 	}
-	ff.Stream(nil)
-	meta := &source.Meta{
-		Size: ff.Size,
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.uploadCount++
+	uploadId := strconv.Itoa(this.uploadCount)
+	this.uploads[uploadId] = make(map[int64][]byte)
+	return uploadId, nil
+}
+
+func (this *FakeUpstreamSource) UploadPart(uri, uploadId string, partNumber int64, body io.ReadSeeker, opts *source.UploadOptions) (string, error) {
+	this.recordOptions(uri, opts)
+	if this.isUnavailable() {
+		return "", ErrUnavailable
+	}
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
 	}
 
-	return ff, meta, nil
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	parts, ok := this.uploads[uploadId]
+	if !ok {
+		return "", awserr.New("NoSuchUpload", "The specified upload does not exist.", nil)
+	}
+	parts[partNumber] = content
+	return contentETag(content), nil
 }
 
-func (this *FakeUpstreamSource) GetMeta(uri string) (*source.Meta, error) {
-	return &source.Meta{}, nil
+func (this *FakeUpstreamSource) CompleteMultipartUpload(uri, uploadId string, completed []source.CompletedPart, opts *source.UploadOptions) (*source.Meta, error) {
+	atomic.AddInt32(&this.PutCount, 1)
+	this.recordOptions(uri, opts)
+
+	this.lock.Lock()
+	this.CompletedParts[uri] = completed
+	this.lock.Unlock()
+
+	if this.isUnavailable() {
+		return nil, ErrUnavailable
+	}
+
+	this.lock.Lock()
+	parts, ok := this.uploads[uploadId]
+	delete(this.uploads, uploadId)
+	this.lock.Unlock()
+
+	if !ok {
+		return nil, awserr.New("NoSuchUpload", "The specified upload does not exist.", nil)
+	}
+
+	var content []byte
+	for _, part := range completed {
+		p, ok := parts[part.PartNumber]
+		if !ok || contentETag(p) != part.ETag {
+			return nil, awserr.New("InvalidPart", "One or more of the specified parts could not be found.", nil)
+		}
+		content = append(content, p...)
+	}
+	return this.write(uri, content), nil
 }
 
-func (this *FakeUpstreamSource) Directory(dir string) ([]string, error) {
-	return []string{}, nil
+func (this *FakeUpstreamSource) AbortMultipartUpload(uri, uploadId string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.uploads, uploadId)
+	return nil
 }
 
 type GeneratedContentReader interface {
 	io.Reader
 	Size()      int64
+	ETag()      string
+}
+
+func contentETag(content []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(content))
+}
+
+// RangeSource is implemented by generated sources which can also serve
+// ranged requests.
+type RangeSource interface {
+	GetRange(start, end int64) (io.ReadCloser, error)
 }
 
 type ErroringSource struct {
@@ -100,6 +515,10 @@ func (this *ErroringSource) Size() int64 {
 	return int64(len(this.Content))
 }
 
+func (this *ErroringSource) ETag() string {
+	return contentETag(this.Content)
+}
+
 func (this *ErroringSource) Read(p []byte) (int, error) {
 	if this.closed {
 		return 0, errors.New("Read failed: source is closed")
@@ -125,6 +544,45 @@ func (this *ErroringSource) GetMeta(uri string) (*source.Meta, error) {
 	return &source.Meta{}, nil
 }
 
+// CorruptSource delivers content which doesn't match its ETag.
+type CorruptSource struct {
+	*IntegerSequenceSource
+	etag string
+}
+
+func NewCorruptSource(size int) *CorruptSource {
+	ss := NewIntegerStreamingSource(size)
+	etag := contentETag(append([]byte("corrupt"), ss.Content...))
+	return &CorruptSource{ss, etag}
+}
+
+func (this *CorruptSource) ETag() string {
+	return this.etag
+}
+
+// FlakySource fails after sending half its content, but can be resumed with
+// ranged requests.
+type FlakySource struct {
+	*IntegerSequenceSource
+}
+
+func NewFlakySource(size int) *FlakySource {
+	return &FlakySource{NewIntegerStreamingSource(size)}
+}
+
+func (this *FlakySource) Read(p []byte) (int, error) {
+	if this.offset > len(this.Content) / 2 {
+		return 0, errors.New("Connection reset")
+	}
+
+	// Never hand out more than the first half plus a little
+	end := len(this.Content) / 2 + 1
+	if end - this.offset < len(p) {
+		p = p[:end - this.offset]
+	}
+	return this.IntegerSequenceSource.Read(p)
+}
+
 type IntegerSequenceSource struct {
 	Content []byte
 	offset  int
@@ -148,6 +606,29 @@ func (this *IntegerSequenceSource) Size() int64 {
 	return int64(len(this.Content))
 }
 
+func (this *IntegerSequenceSource) ETag() string {
+	return contentETag(this.Content)
+}
+
+// SlowSource takes a while to deliver its first bytes, once the response has
+// already started.
+type SlowSource struct {
+	*IntegerSequenceSource
+	started bool
+}
+
+func NewSlowSource(size int) *SlowSource {
+	return &SlowSource{IntegerSequenceSource: NewIntegerStreamingSource(size)}
+}
+
+func (this *SlowSource) Read(p []byte) (int, error) {
+	if !this.started {
+		this.started = true
+		time.Sleep(SlowGetDelay)
+	}
+	return this.IntegerSequenceSource.Read(p)
+}
+
 func (this *IntegerSequenceSource) Read(p []byte) (int, error) {
 	if this.closed {
 		return 0, errors.New("Read failed: source is closed")
@@ -163,6 +644,13 @@ func (this *IntegerSequenceSource) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+func (this *IntegerSequenceSource) GetRange(start, end int64) (io.ReadCloser, error) {
+	if start < 0 || end > int64(len(this.Content)) || start > end {
+		return nil, errors.New("Invalid range")
+	}
+	return ioutil.NopCloser(bytes.NewReader(this.Content[start:end])), nil
+}
+
 func (this *IntegerSequenceSource) Close() error {
 	this.closed = true
 	return nil
@@ -0,0 +1,39 @@
+package faulting
+
+// Bitmap records which blocks of a FaultingFile are present on disk.
+type Bitmap []uint64
+
+func NewBitmap(n int) Bitmap {
+	return make(Bitmap, (n+63)/64)
+}
+
+func (this Bitmap) Set(i int) {
+	this[i/64] |= 1 << uint(i%64)
+}
+
+func (this Bitmap) Clear(i int) {
+	this[i/64] &^= 1 << uint(i%64)
+}
+
+func (this Bitmap) IsSet(i int) bool {
+	if i/64 >= len(this) {
+		return false
+	}
+	return this[i/64]&(1<<uint(i%64)) != 0
+}
+
+// Copy returns a snapshot which is safe to use without the file's lock.
+func (this Bitmap) Copy() Bitmap {
+	return append(Bitmap{}, this...)
+}
+
+// Count returns the number of blocks present.
+func (this Bitmap) Count() int {
+	count := 0
+	for _, word := range this {
+		for ; word != 0; word &= word - 1 {
+			count++
+		}
+	}
+	return count
+}
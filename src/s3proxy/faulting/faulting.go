@@ -1,8 +1,10 @@
 package faulting
 
 import (
+	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 	"os"
 	"path"
@@ -20,9 +22,11 @@ type FaultingReader struct {
 	faultingFile	*FaultingFile
 	bytesRead		int64
 	context         context.Context
+	closed          int32
 }
 
 func NewFaultingReader(ctx context.Context, f *FaultingFile) *FaultingReader {
+	atomic.AddInt32(&f.readers, 1)
 	return &FaultingReader{
 		faultingFile: f,
 		bytesRead: 0,
@@ -55,7 +59,36 @@ func (this *FaultingReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// Seek only moves the read offset. The block containing the new offset is
+// faulted in on the next Read, so earlier blocks are never touched.
+func (this *FaultingReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = this.bytesRead + offset
+	case io.SeekEnd:
+		abs = this.Size() + offset
+	default:
+		return 0, errors.New("FaultingReader.Seek: invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("FaultingReader.Seek: negative position")
+	}
+
+	this.bytesRead = abs
+	return abs, nil
+}
+
 func (this *FaultingReader) Close() error {
+	if this == nil {
+		return nil
+	}
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		atomic.AddInt32(&this.faultingFile.readers, -1)
+	}
 	return nil
 }
 
@@ -63,15 +96,58 @@ func (this *FaultingReader) Size() int64 {
 	return this.faultingFile.Size
 }
 
+// RangeFetcher returns the bytes [start, end) of the upstream object.
+type RangeFetcher func(start, end int64) (io.ReadCloser, error)
+
+// Blocks this close to the sequential stream are left for the stream to fill
+// rather than being fetched with a ranged request.
+const FAULT_AHEAD_BLOCKS = 4
+
+// How often, and how patiently, an interrupted upstream stream is resumed
+const UPSTREAM_RETRIES = 3
+const RETRY_BACKOFF = 500 * time.Millisecond
+
+// ErrChanged is returned by a RangeFetcher when the upstream object no longer
+// matches the one being cached. Such a download can never be resumed.
+var ErrChanged = errors.New("upstream object has changed")
+
+// While streaming, progress is checkpointed after this many blocks
+const CHECKPOINT_BLOCKS = 64
+
+// A Checkpoint persists which blocks of a file are present on disk, along
+// with their checksums.
+type Checkpoint func(blocks Bitmap, sums []uint32, complete bool)
+
 type FaultingFile struct {
 	Src         io.Reader
 	Dst         string
 	BlockCache  *ccache.SecondaryCache
-	BlockCount  int
 	Size        int64
-	UpstreamErr error
 	Lock        sync.Mutex
 	BlockSize   int
+	Fetcher     RangeFetcher
+
+	// Resuming the stream after an upstream error. The backoff doubles with
+	// every attempt.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Guarded by Lock
+	BlockCount  int
+	UpstreamErr error
+
+	blocks      Bitmap
+	sums        []uint32
+	fetching    map[int]bool
+	arrived     chan struct{}
+	verifiers   []*Verifier
+	verified    bool
+
+	checkpointFn   Checkpoint
+	checkpointLock sync.Mutex
+	readers     int32
+	streaming   int32
+	noMemory    bool
 }
 
 func NewFaultingFile(src io.Reader, dst string, size int64, cache *ccache.SecondaryCache) (*FaultingFile, error) {
@@ -89,42 +165,433 @@ func NewFaultingFile(src io.Reader, dst string, size int64, cache *ccache.Second
 		}
 	}
 
-	return &FaultingFile{
+	ff := &FaultingFile{
 		BlockCache: cache,
 		Src: src,
 		Dst: dst,
 		Size: size,
-		BlockSize: BLOCK_SIZE,
-	}, nil
+		fetching: make(map[int]bool),
+		arrived: make(chan struct{}),
+		Retries: UPSTREAM_RETRIES,
+		RetryBackoff: RETRY_BACKOFF,
+	}
+	ff.SetBlockSize(BLOCK_SIZE)
+
+	return ff, nil
 }
 
 func (this *FaultingFile) Stream(wg *sync.WaitGroup) {
+	atomic.StoreInt32(&this.streaming, 1)
 	go this.readAll(wg)
 }
 
+// InUse reports whether the file is still being downloaded or has open
+// readers, in which case it must not be removed from disk.
+func (this *FaultingFile) InUse() bool {
+	return atomic.LoadInt32(&this.readers) > 0 || atomic.LoadInt32(&this.streaming) > 0
+}
+
+// DisableMemoryCache drops any blocks kept in the in-memory block cache and
+// stops any more being kept, so that they are always read from disk.
+func (this *FaultingFile) DisableMemoryCache() {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	this.dropMemoryCache()
+}
+
+// dropMemoryCache must be called with the lock held.
+func (this *FaultingFile) dropMemoryCache() {
+	this.noMemory = true
+	for i := 0; i < this.NumBlocks(); i++ {
+		this.BlockCache.Delete(strconv.Itoa(i))
+	}
+}
+
+// Relocate moves the file out of the way while it is still being read, so
+// that its path can be reused for another object. Readers, and any download,
+// carry on with the file in its new place. The in-memory block cache is
+// shared with whatever replaces the file, so it isn't used any more.
+func (this *FaultingFile) Relocate(dst string) error {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	err := os.Rename(this.Dst, dst)
+	if err != nil {
+		return err
+	}
+	this.Dst = dst
+	this.dropMemoryCache()
+	return nil
+}
+
+// openDst opens the file at its current path. The lock is held so that the
+// file can't be relocated in the meantime.
+func (this *FaultingFile) openDst(flag int) (*os.File, error) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return os.OpenFile(this.Dst, flag, 0644)
+}
+
+func (this *FaultingFile) path() string {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return this.Dst
+}
+
+func (this *FaultingFile) memoryCached() bool {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return !this.noMemory
+}
+
+// cacheBlock keeps a block in memory, unless that has been disabled.
+func (this *FaultingFile) cacheBlock(i int, buf []byte) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if !this.noMemory {
+		this.BlockCache.Set(strconv.Itoa(i), buf, 100)
+	}
+}
+
 func (this *FaultingFile) SetBlockSize(blockSize int) {
 	this.BlockSize = blockSize
+	this.blocks = NewBitmap(this.NumBlocks())
+	this.sums = make([]uint32, this.NumBlocks())
+}
+
+// blockLen is the size of block i, which is less than BlockSize for the last
+// block.
+func (this *FaultingFile) blockLen(i int) int {
+	end := int64(i + 1) * int64(this.BlockSize)
+	if end > this.Size {
+		end = this.Size
+	}
+	return int(end - int64(i) * int64(this.BlockSize))
+}
+
+// NumBlocks is the number of blocks needed to hold the whole file.
+func (this *FaultingFile) NumBlocks() int {
+	return int((this.Size + int64(this.BlockSize) - 1) / int64(this.BlockSize))
+}
+
+// MarkComplete flags every block as present, for files which are already
+// fully on disk.
+func (this *FaultingFile) MarkComplete() {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	for i := 0; i < this.NumBlocks(); i++ {
+		this.blocks.Set(i)
+	}
+	this.BlockCount = this.NumBlocks()
+	this.notify()
+}
+
+// SetBlocks restores the blocks known to be on disk, for example after a
+// restart. Missing blocks can only be fetched with the Fetcher.
+func (this *FaultingFile) SetBlocks(blocks Bitmap) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	this.blocks = NewBitmap(this.NumBlocks())
+	copy(this.blocks, blocks)
+
+	this.BlockCount = 0
+	for this.blocks.IsSet(this.BlockCount) {
+		this.BlockCount++
+	}
+	this.notify()
+}
+
+// SetSums restores the checksums of the blocks on disk. Without them, blocks
+// read from disk can't be checked.
+func (this *FaultingFile) SetSums(sums []uint32) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if len(sums) != this.NumBlocks() {
+		this.sums = nil
+		return
+	}
+	this.sums = append([]uint32{}, sums...)
+}
+
+// Complete reports whether every block is on disk.
+func (this *FaultingFile) Complete() bool {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return this.blocks.Count() == this.NumBlocks()
+}
+
+// SetCheckpoint registers the function used to persist progress. It is
+// called once straight away so that progress made before it was registered
+// is not lost.
+func (this *FaultingFile) SetCheckpoint(fn Checkpoint) {
+	this.Lock.Lock()
+	this.checkpointFn = fn
+	this.Lock.Unlock()
+
+	this.checkpoint()
+}
+
+func (this *FaultingFile) checkpoint() {
+	this.checkpointWith(-1)
+}
+
+// checkpointWith hands a snapshot of the present blocks, plus block extra if
+// it isn't negative, to the Checkpoint. A block is checkpointed before being
+// released to readers, so that a complete file is always recorded as such
+// before it can have been served. Snapshots are taken and persisted one at a
+// time so that an older one can never overwrite a newer one.
+func (this *FaultingFile) checkpointWith(extra int) {
+	this.checkpointLock.Lock()
+	defer this.checkpointLock.Unlock()
+
+	this.Lock.Lock()
+	fn := this.checkpointFn
+	blocks := this.blocks.Copy()
+	if extra >= 0 {
+		blocks.Set(extra)
+	}
+	var sums []uint32
+	if this.sums != nil {
+		sums = append(sums, this.sums...)
+	}
+	complete := blocks.Count() == this.NumBlocks()
+	this.Lock.Unlock()
+
+	if fn != nil {
+		fn(blocks, sums, complete)
+	}
+}
+
+// syncedCheckpoint only checkpoints once the blocks written to f are known to
+// be on disk, so that a crash can't leave a checkpoint claiming blocks which
+// never made it there.
+func (this *FaultingFile) syncedCheckpoint(f *os.File, extra int) {
+	if err := f.Sync(); err != nil {
+		log.Errorf("Unable to sync %s, not checkpointing - %s", this.path(), err)
+		return
+	}
+	this.checkpointWith(extra)
+}
+
+// notify wakes up every reader waiting for a block. Must be called with the
+// lock held.
+func (this *FaultingFile) notify() {
+	close(this.arrived)
+	this.arrived = make(chan struct{})
+}
+
+// fail records an upstream error and wakes up any waiting readers so that
+// they can return it.
+func (this *FaultingFile) fail(err error) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	this.UpstreamErr = err
+	this.notify()
+}
+
+// Err returns the error which ended the upstream stream, if any.
+func (this *FaultingFile) Err() error {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return this.UpstreamErr
+}
+
+func (this *FaultingFile) HasBlock(i int) bool {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return this.blocks.IsSet(i)
 }
 
 func (this *FaultingFile) GetBlock(ctx context.Context, i int) ([]byte, error) {
-	if this.UpstreamErr != nil {
-		return nil, this.UpstreamErr
+	for {
+		this.Lock.Lock()
+		upstreamErr := this.UpstreamErr
+		present := this.blocks.IsSet(i)
+		fetch := !present && !this.fetching[i] && this.shouldFetch(i)
+		if fetch {
+			this.fetching[i] = true
+		}
+		// Nothing is ever going to deliver this block
+		stranded := this.Fetcher == nil && (this.Src == nil || i < this.BlockCount)
+		arrived := this.arrived
+		this.Lock.Unlock()
+
+		if upstreamErr != nil {
+			return nil, upstreamErr
+		}
+
+		if present {
+			break
+		}
+
+		if fetch {
+			return this.fetchBlock(i)
+		}
+
+		if stranded {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		// Wait for the next block to land, whoever delivers it
+		select {
+		case <-arrived:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	for i >= this.BlockCount {
-		time.Sleep(1000 * time.Millisecond)
-		if this.UpstreamErr != nil {
-			return nil, this.UpstreamErr
+	// Blocks only go into memory through cacheBlock, so that none are kept
+	// once the file has been relocated
+	var buf []byte
+	var err error
+	if this.memoryCached() {
+		buf = this.getCachedBlock(i)
+	}
+	if buf == nil {
+		buf, err = this.faultInBlock(i)
+		if err == nil {
+			this.cacheBlock(i, buf)
 		}
 	}
 
-	entry, err := this.BlockCache.Fetch(strconv.Itoa(i), time.Second, func() (interface{}, error) {return this.faultInBlock(i)})
+	if err == ErrCorrupt {
+		log.Errorf("Block %d of %s is corrupt", i, this.path())
+		if this.discardBlock(i) {
+			return this.GetBlock(ctx, i)
+		}
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	return entry.Value().([]byte), nil
+	return buf, nil
+}
+
+// discardBlock marks a block as missing so that it is fetched again. Returns
+// false if it can't be.
+func (this *FaultingFile) discardBlock(i int) bool {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if this.Fetcher == nil {
+		return false
+	}
+	this.blocks.Clear(i)
+	if !this.noMemory {
+		this.BlockCache.Delete(strconv.Itoa(i))
+	}
+	return true
+}
+
+// Scrub re-reads every block on disk and checks it against its checksum,
+// calling throttle with the number of bytes read after each one. Corrupt
+// blocks are discarded, to be fetched again, and returned.
+func (this *FaultingFile) Scrub(throttle func(n int)) []int {
+	// Keep the file from being evicted while it is read
+	atomic.AddInt32(&this.readers, 1)
+	defer atomic.AddInt32(&this.readers, -1)
+
+	var corrupt []int
+	for i := 0; i < this.NumBlocks(); i++ {
+		if !this.HasBlock(i) {
+			continue
+		}
+
+		_, err := this.faultInBlock(i)
+		if err == ErrCorrupt {
+			log.Errorf("Scrubbing found block %d of %s is corrupt", i, this.path())
+			corrupt = append(corrupt, i)
+			this.discardBlock(i)
+		} else if err != nil {
+			// Most likely removed from underneath us
+			log.Debugf("Unable to scrub %s: %s", this.path(), err)
+			break
+		}
+
+		throttle(this.blockLen(i))
+	}
+	return corrupt
+}
+
+// shouldFetch decides whether a missing block is fetched directly from
+// upstream or left for the sequential stream. Must be called with the lock
+// held.
+func (this *FaultingFile) shouldFetch(i int) bool {
+	if this.Fetcher == nil {
+		return false
+	}
+
+	// Nothing is streaming this file, or the stream has already gone past
+	// this block, so it will never arrive otherwise
+	if this.Src == nil || i < this.BlockCount {
+		return true
+	}
+
+	return i >= this.BlockCount + FAULT_AHEAD_BLOCKS
+}
+
+// fetchBlock retrieves a single block with a ranged upstream request and
+// writes it into its place in the cache file.
+func (this *FaultingFile) fetchBlock(i int) ([]byte, error) {
+	defer func() {
+		this.Lock.Lock()
+		delete(this.fetching, i)
+		// Readers who left this block to us may need to fetch it themselves
+		this.notify()
+		this.Lock.Unlock()
+	}()
+
+	start := int64(i * this.BlockSize)
+	end := start + int64(this.BlockSize)
+	if end > this.Size {
+		end = this.Size
+	}
+
+	log.Debugf("Fetching block %d of %s", i, this.path())
+
+	body, err := this.Fetcher(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	buf := make([]byte, this.BlockSize)
+	_, err = io.ReadFull(body, buf[:end - start])
+	if err != nil {
+		return nil, err
+	}
+
+	dstFile, err := this.openDst(os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	defer dstFile.Close()
+
+	_, err = dstFile.WriteAt(buf[:end - start], start)
+	if err != nil {
+		return nil, err
+	}
+
+	this.cacheBlock(i, buf)
+
+	this.Lock.Lock()
+	this.setSum(i, blockSum(buf[:end - start]))
+	this.Lock.Unlock()
+
+	this.syncedCheckpoint(dstFile, i)
+
+	this.Lock.Lock()
+	this.blocks.Set(i)
+	this.notify()
+	this.Lock.Unlock()
+
+	return buf, nil
 }
 
 func (this *FaultingFile) getCachedBlock(i int) []byte {
@@ -140,10 +607,39 @@ func (this *FaultingFile) getCachedBlock(i int) []byte {
 	return nil
 }
 
+// setSum records the checksum of a block. Must be called with the lock held.
+func (this *FaultingFile) setSum(i int, sum uint32) {
+	if this.sums != nil {
+		this.sums[i] = sum
+	}
+}
+
+// faultInBlock reads a block from disk, checking it against its checksum if
+// there is one.
 func (this *FaultingFile) faultInBlock(i int) ([]byte, error) {
+	buf, err := this.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+
+	this.Lock.Lock()
+	checked := this.sums != nil
+	var sum uint32
+	if checked {
+		sum = this.sums[i]
+	}
+	this.Lock.Unlock()
+
+	if checked && blockSum(buf[:this.blockLen(i)]) != sum {
+		return nil, ErrCorrupt
+	}
+	return buf, nil
+}
+
+func (this *FaultingFile) readBlock(i int) ([]byte, error) {
 	buf := make([]byte, this.BlockSize)
 
-	dst, err := os.Open(this.Dst)
+	dst, err := this.openDst(os.O_RDONLY)
 	if err != nil {
 		return nil, err
 	}
@@ -170,38 +666,164 @@ func (this *FaultingFile) readAll(wg *sync.WaitGroup) {
 	var bytesRead int64
 	var bytesWritten int64
 
-	dstFile, err := os.Create(this.Dst)
+	// Blocks may already have been fetched out of order, so the file must not
+	// be truncated here.
+	dstFile, err := this.openDst(os.O_WRONLY|os.O_CREATE)
 	defer dstFile.Close()
 
 	defer func() {
+		if dstFile != nil {
+			this.syncedCheckpoint(dstFile, -1)
+		} else {
+			this.checkpoint()
+		}
+		atomic.StoreInt32(&this.streaming, 0)
 		if wg != nil {
 			wg.Done()
 		}
 	} ()
 
 	if err != nil {
-		this.UpstreamErr = err
+		this.fail(err)
 		return
 	}
 
 	for bytesRead < this.Size {
+		expected := this.Size - bytesRead
+		if expected > int64(this.BlockSize) {
+			expected = int64(this.BlockSize)
+		}
+
 		buf := make([]byte, this.BlockSize)
 		m, err := io.ReadFull(this.Src, buf)
-		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-			this.UpstreamErr = err
-			break
+		if int64(m) < expected {
+			// The upstream ended before delivering everything it promised
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			// Any partial block is simply fetched again
+			err = this.resume(bytesRead, err)
+			if err != nil {
+				this.fail(err)
+				break
+			}
+			continue
 		}
 
-		n, err := dstFile.Write(buf[:m])
-		if err != nil {
-			this.UpstreamErr = err
+		// Checksums cover the whole file, so a mismatch is only found once the
+		// last block has arrived. Earlier blocks have been released to readers
+		// by then; it's the last block which is held back, and readers fail
+		// with ErrChecksum when they reach it.
+		for _, v := range this.verifiers {
+			v.Write(buf[:m])
+		}
+		if bytesRead + int64(m) >= this.Size && !this.verify() {
+			this.fail(ErrChecksum)
 			break
 		}
 
+		this.Lock.Lock()
+		i := this.BlockCount
+		present := this.blocks.IsSet(i)
+		this.Lock.Unlock()
+
+		if !present {
+			n, err := dstFile.WriteAt(buf[:m], bytesRead)
+			if err != nil {
+				this.fail(err)
+				break
+			}
+			bytesWritten += int64(n)
+			this.cacheBlock(i, buf)
+		}
+
 		bytesRead += int64(m)
-		bytesWritten += int64(n)
 
-		this.BlockCache.Set(strconv.Itoa(this.BlockCount), buf, 100)
+		if !present {
+			this.Lock.Lock()
+			this.setSum(i, blockSum(buf[:m]))
+			this.Lock.Unlock()
+		}
+
+		if (i + 1) % CHECKPOINT_BLOCKS == 0 || bytesRead >= this.Size {
+			this.syncedCheckpoint(dstFile, i)
+		}
+
+		this.Lock.Lock()
+		this.blocks.Set(i)
 		this.BlockCount++
+		this.notify()
+		this.Lock.Unlock()
+	}
+}
+
+// verify compares the streamed content against every Verifier.
+func (this *FaultingFile) verify() bool {
+	for _, v := range this.verifiers {
+		if !v.Matches() {
+			log.Errorf("%s checksum mismatch for %s", v.Name, this.path())
+			return false
+		}
+	}
+
+	if len(this.verifiers) > 0 {
+		this.Lock.Lock()
+		this.verified = true
+		this.Lock.Unlock()
 	}
+	return true
+}
+
+// AddVerifier checks the streamed content against another checksum. It must
+// be called before Stream; nil Verifiers are ignored.
+func (this *FaultingFile) AddVerifier(v *Verifier) {
+	if v != nil {
+		this.verifiers = append(this.verifiers, v)
+	}
+}
+
+// Verified reports whether the whole file was streamed and matched every
+// checksum the upstream advertised.
+func (this *FaultingFile) Verified() bool {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return this.verified
+}
+
+// resume replaces an interrupted Src with a ranged request for the rest of
+// the file, starting at offset. Readers carry on waiting in the meantime.
+func (this *FaultingFile) resume(offset int64, cause error) error {
+	if this.Fetcher == nil || cause == ErrChanged {
+		return cause
+	}
+
+	backoff := this.RetryBackoff
+	for attempt := 1; attempt <= this.Retries; attempt++ {
+		log.Warningf("Upstream for %s failed at byte %d: %s - retry %d of %d in %s",
+			this.path(), offset, cause, attempt, this.Retries, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		body, err := this.Fetcher(offset, this.Size)
+		if err == ErrChanged {
+			return err
+		}
+		if err != nil {
+			cause = err
+			continue
+		}
+
+		this.Lock.Lock()
+		if c, ok := this.Src.(io.Closer); ok {
+			c.Close()
+		}
+		this.Src = body
+		this.Lock.Unlock()
+
+		log.Infof("Resumed %s at byte %d", this.path(), offset)
+		return nil
+	}
+
+	return cause
 }
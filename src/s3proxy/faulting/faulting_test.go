@@ -12,10 +12,11 @@ import (
 	"github.com/karlseguin/ccache"
 	"s3proxy/context"
 	"golang.org/x/net/context"
+	"time"
 )
 
 func makeContext(id uint64) context.Context {
-	return context.WithValue(context.Background(), 0, &cache_context.Context{id})
+	return context.WithValue(context.Background(), 0, &cache_context.Context{Sequence: id})
 }
 
 var _ = Describe("When faulting in a file", func() {
@@ -182,6 +183,248 @@ var _ = Describe("When faulting in a file", func() {
 			Expect(string(buf2[:n])).To(Equal(" 6 7 8 9 10"))
 		})
 
+		It("fetches blocks ahead of the stream with ranged requests", func() {
+			ss := fakes.NewIntegerStreamingSource(1000)
+			cacheFile, err := ioutil.TempFile("", "cached4")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			// The sequential stream never delivers anything
+			pr, pw := io.Pipe()
+			defer pw.Close()
+
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(pr, cacheFile.Name(), int64(len(ss.Content)), sCache)
+			Expect(err).To(BeNil())
+
+			ff.SetBlockSize(11)
+			ff.Fetcher = ss.GetRange
+			ff.Stream(nil)
+
+			fr := faulting.NewFaultingReader(makeContext(4), ff)
+			_, err = fr.Seek(-7, io.SeekEnd)
+			Expect(err).To(BeNil())
+
+			buf := make([]byte, 20)
+			n, err := fr.Read(buf)
+			Expect(err).To(BeNil())
+			Expect(string(buf[:n])).To(Equal("98 999 "))
+
+			lastBlock := ff.NumBlocks() - 1
+			Expect(ff.HasBlock(lastBlock)).To(BeTrue())
+			Expect(ff.HasBlock(0)).To(BeFalse())
+
+			sinkData, err := ioutil.ReadFile(cacheFile.Name())
+			Expect(err).To(BeNil())
+			Expect(sinkData[lastBlock * 11:]).To(Equal(ss.Content[lastBlock * 11:]))
+		})
+
+		It("wakes waiting readers as soon as a block arrives", func() {
+			cacheFile, err := ioutil.TempFile("", "cached4")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			pr, pw := io.Pipe()
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(pr, cacheFile.Name(), 20, sCache)
+			Expect(err).To(BeNil())
+			ff.SetBlockSize(10)
+			ff.Stream(nil)
+
+			fr := faulting.NewFaultingReader(makeContext(5), ff)
+			read := make(chan string)
+			go func() {
+				buf := make([]byte, 10)
+				n, _ := fr.Read(buf)
+				read <- string(buf[:n])
+			}()
+
+			Consistently(read, "100ms").ShouldNot(Receive())
+
+			pw.Write([]byte("0 1 2 3 4 "))
+			Eventually(read, "100ms").Should(Receive(Equal("0 1 2 3 4 ")))
+			pw.Close()
+		})
+
+		It("stops waiting when the context is cancelled", func() {
+			cacheFile, err := ioutil.TempFile("", "cached5")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(pr, cacheFile.Name(), 20, sCache)
+			Expect(err).To(BeNil())
+			ff.SetBlockSize(10)
+			ff.Stream(nil)
+
+			ctx, cancel := context.WithCancel(makeContext(6))
+			fr := faulting.NewFaultingReader(ctx, ff)
+			readErr := make(chan error)
+			go func() {
+				_, err := fr.Read(make([]byte, 10))
+				readErr <- err
+			}()
+
+			cancel()
+			Eventually(readErr, "100ms").Should(Receive(Equal(context.Canceled)))
+		})
+
+		It("resumes an interrupted stream with a ranged request", func() {
+			fs := fakes.NewFlakySource(1000)
+			cacheFile, err := ioutil.TempFile("", "cached6")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(fs, cacheFile.Name(), int64(len(fs.Content)), sCache)
+			Expect(err).To(BeNil())
+			ff.SetBlockSize(100)
+			ff.Fetcher = fs.GetRange
+			ff.RetryBackoff = 10 * time.Millisecond
+
+			fr := faulting.NewFaultingReader(makeContext(7), ff)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			ff.Stream(&wg)
+
+			data, err := ioutil.ReadAll(fr)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(fs.Content))
+
+			wg.Wait()
+			Expect(ff.Err()).To(BeNil())
+
+			sinkData, err := ioutil.ReadFile(cacheFile.Name())
+			Expect(err).To(BeNil())
+			Expect(sinkData).To(Equal(fs.Content))
+		})
+
+		It("does not resume an object which has changed", func() {
+			fs := fakes.NewFlakySource(1000)
+			cacheFile, err := ioutil.TempFile("", "cached7")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(fs, cacheFile.Name(), int64(len(fs.Content)), sCache)
+			Expect(err).To(BeNil())
+			ff.SetBlockSize(100)
+			ff.Fetcher = func(start, end int64) (io.ReadCloser, error) {
+				return nil, faulting.ErrChanged
+			}
+			ff.RetryBackoff = 10 * time.Millisecond
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			ff.Stream(&wg)
+			wg.Wait()
+
+			Expect(ff.Err()).To(Equal(faulting.ErrChanged))
+		})
+
+		It("verifies the content against its checksums", func() {
+			ss := fakes.NewIntegerStreamingSource(100)
+			cacheFile, err := ioutil.TempFile("", "cached8")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(ss, cacheFile.Name(), int64(len(ss.Content)), sCache)
+			Expect(err).To(BeNil())
+			ff.SetBlockSize(100)
+			ff.AddVerifier(faulting.MD5Verifier(ss.ETag()))
+			ff.AddVerifier(faulting.MD5Verifier("\"abc-2\""))
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			ff.Stream(&wg)
+			wg.Wait()
+
+			Expect(ff.Err()).To(BeNil())
+			Expect(ff.Verified()).To(BeTrue())
+		})
+
+		It("fails when the content does not match its checksum", func() {
+			cs := fakes.NewCorruptSource(100)
+			cacheFile, err := ioutil.TempFile("", "cached9")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(cs, cacheFile.Name(), int64(len(cs.Content)), sCache)
+			Expect(err).To(BeNil())
+			ff.SetBlockSize(100)
+			ff.AddVerifier(faulting.MD5Verifier(cs.ETag()))
+
+			fr := faulting.NewFaultingReader(makeContext(8), ff)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			ff.Stream(&wg)
+
+			_, err = ioutil.ReadAll(fr)
+			Expect(err).To(Equal(faulting.ErrChecksum))
+
+			wg.Wait()
+			Expect(ff.Verified()).To(BeFalse())
+			Expect(ff.Complete()).To(BeFalse())
+		})
+
+		It("re-fetches blocks which are corrupt on disk", func() {
+			ss := fakes.NewIntegerStreamingSource(100)
+			cacheFile, err := ioutil.TempFile("", "cached10")
+			Expect(err).To(BeNil())
+			defer os.Remove(cacheFile.Name())
+			cacheFile.Close()
+
+			cache := ccache.Layered(ccache.Configure().MaxSize(100))
+			sCache := cache.GetOrCreateSecondaryCache("primary")
+			ff, err := faulting.NewFaultingFile(ss, cacheFile.Name(), int64(len(ss.Content)), sCache)
+			Expect(err).To(BeNil())
+			ff.SetBlockSize(100)
+			ff.Fetcher = ss.GetRange
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			ff.Stream(&wg)
+			wg.Wait()
+
+			f, err := os.OpenFile(cacheFile.Name(), os.O_WRONLY, 0644)
+			Expect(err).To(BeNil())
+			f.WriteAt([]byte("rot"), 150)
+			f.Close()
+			sCache.Delete("1")
+
+			Expect(ff.Scrub(func(int) {})).To(Equal([]int{1}))
+			Expect(ff.HasBlock(1)).To(BeFalse())
+
+			fr := faulting.NewFaultingReader(makeContext(9), ff)
+			data, err := ioutil.ReadAll(fr)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(ss.Content))
+
+			sinkData, err := ioutil.ReadFile(cacheFile.Name())
+			Expect(err).To(BeNil())
+			Expect(sinkData).To(Equal(ss.Content))
+		})
+
 		It("FaultingReader with default block size", func() {
 			ss := fakes.NewIntegerStreamingSource(1000)
 			cacheFile, err := ioutil.TempFile("", "cached3")
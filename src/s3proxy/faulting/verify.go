@@ -0,0 +1,77 @@
+package faulting
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// ErrChecksum is returned when the content streamed from upstream doesn't
+// match a checksum the upstream advertised for it. It can only be known at the
+// end of the stream, so readers get it in place of the last block.
+var ErrChecksum = errors.New("upstream content does not match its checksum")
+
+// ErrCorrupt is returned when a block on disk no longer matches the checksum
+// recorded when it was written.
+var ErrCorrupt = errors.New("cached block is corrupt")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// blockSum is the checksum kept for every block written to disk.
+func blockSum(p []byte) uint32 {
+	return crc32.Checksum(p, castagnoli)
+}
+
+// A Verifier checks the content of a whole file, as it is streamed, against a
+// checksum advertised by the upstream.
+type Verifier struct {
+	Name     string
+	hash     hash.Hash
+	expected string
+	encode   func([]byte) string
+}
+
+func (this *Verifier) Write(p []byte) (int, error) {
+	return this.hash.Write(p)
+}
+
+func (this *Verifier) Matches() bool {
+	return this.encode(this.hash.Sum(nil)) == this.expected
+}
+
+// MD5Verifier checks content against an S3 ETag. The ETags of multipart
+// uploads are not an MD5 of the content, in which case nil is returned.
+func MD5Verifier(etag string) *Verifier {
+	etag = strings.ToLower(strings.Trim(etag, "\""))
+	if etag == "" || strings.Contains(etag, "-") {
+		return nil
+	}
+	return &Verifier{"MD5", md5.New(), etag, hex.EncodeToString}
+}
+
+// CRC32CVerifier checks content against a base64 x-amz-checksum-crc32c.
+func CRC32CVerifier(checksum string) *Verifier {
+	if !wholeObjectChecksum(checksum) {
+		return nil
+	}
+	return &Verifier{"CRC32C", crc32.New(castagnoli), checksum, base64.StdEncoding.EncodeToString}
+}
+
+// SHA256Verifier checks content against a base64 x-amz-checksum-sha256.
+func SHA256Verifier(checksum string) *Verifier {
+	if !wholeObjectChecksum(checksum) {
+		return nil
+	}
+	return &Verifier{"SHA256", sha256.New(), checksum, base64.StdEncoding.EncodeToString}
+}
+
+// Checksums of multipart uploads are checksums of the parts' checksums and
+// carry a '-<parts>' suffix. They can't be checked against the content.
+func wholeObjectChecksum(checksum string) bool {
+	return checksum != "" && !strings.Contains(checksum, "-")
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"s3proxy/source"
+	"strings"
+	"time"
+)
+
+// writeValidators sets the headers which allow clients to cache and later
+// revalidate an object.
+func writeValidators(w http.ResponseWriter, meta *source.Meta) {
+	if meta.ETag != "" {
+		w.Header().Set("ETag", meta.ETag)
+	}
+
+	if !meta.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", meta.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if !meta.Expires.IsZero() {
+		maxAge := int64(meta.Expires.Sub(time.Now()) / time.Second)
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+		w.Header().Set("Expires", meta.Expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+// checkPreconditions evaluates the conditional request headers, in the order
+// given by RFC 7232, against the object's meta. It returns the status code
+// which should be sent instead of the object or 0 if the request should be
+// served normally.
+func checkPreconditions(req *http.Request, meta *source.Meta) int {
+	if im := req.Header.Get("If-Match"); im != "" {
+		if !etagListMatches(im, meta.ETag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := req.Header.Get("If-Unmodified-Since"); ius != "" {
+		if t, err := http.ParseTime(ius); err == nil && modifiedSince(meta, t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	isRead := req.Method == "GET" || req.Method == "HEAD"
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatches(inm, meta.ETag, true) {
+			if isRead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := req.Header.Get("If-Modified-Since"); ims != "" && isRead {
+		if t, err := http.ParseTime(ims); err == nil && !modifiedSince(meta, t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// checkIfRange reports whether a Range header should be honoured given the
+// request's If-Range header.
+func checkIfRange(req *http.Request, meta *source.Meta) bool {
+	ir := req.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ir, "\"") {
+		return etagMatches(ir, meta.ETag, false)
+	}
+
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	return !meta.LastModified.IsZero() && meta.LastModified.Truncate(time.Second).Equal(t)
+}
+
+func modifiedSince(meta *source.Meta, t time.Time) bool {
+	if meta.LastModified.IsZero() {
+		return true
+	}
+	// HTTP dates only have a resolution of seconds
+	return meta.LastModified.Truncate(time.Second).After(t)
+}
+
+func etagListMatches(list string, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return etag != ""
+	}
+
+	for _, candidate := range strings.Split(list, ",") {
+		if etagMatches(strings.TrimSpace(candidate), etag, weak) {
+			return true
+		}
+	}
+	return false
+}
+
+func etagMatches(candidate string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+
+	if strings.HasPrefix(candidate, "W/") || strings.HasPrefix(etag, "W/") {
+		if !weak {
+			return false
+		}
+		candidate = strings.TrimPrefix(candidate, "W/")
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+
+	return candidate == etag
+}
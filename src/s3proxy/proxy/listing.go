@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"s3proxy/source"
+	"strings"
+)
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Last modified</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Link}}">{{.Name}}</a></td>{{if .IsPrefix}}<td>-</td><td>-</td>{{else}}<td>{{.Size}}</td><td>{{.LastModified.UTC.Format "2006-01-02 15:04:05"}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// listingFormat picks the representation of a directory listing, either from
+// the 'format' query parameter or the Accept header. Plain text is the
+// default.
+func listingFormat(req *http.Request) string {
+	switch req.URL.Query().Get("format") {
+	case "json":
+		return "json"
+	case "html":
+		return "html"
+	case "text":
+		return "text"
+	}
+
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/json"):
+		return "json"
+	case strings.Contains(accept, "text/html"):
+		return "html"
+	}
+	return "text"
+}
+
+type linkedEntry struct {
+	source.DirEntry
+	Link string
+}
+
+// linkedEntries pairs each entry with the proxy path it can be fetched from.
+// Entry names are relative to the bucket, except at the root where they are
+// the buckets themselves.
+func linkedEntries(dirPath string, entries []source.DirEntry) []linkedEntry {
+	base := "/"
+	if p := strings.TrimLeft(dirPath, "/"); p != "" {
+		base = "/" + strings.SplitN(p, "/", 2)[0] + "/"
+	}
+
+	var linked []linkedEntry
+	for _, entry := range entries {
+		linked = append(linked, linkedEntry{entry, base + entry.Name})
+	}
+	return linked
+}
+
+func writeListing(w http.ResponseWriter, req *http.Request, entries []source.DirEntry) error {
+	switch listingFormat(req) {
+	case "json":
+		if entries == nil {
+			entries = []source.DirEntry{}
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return json.NewEncoder(w).Encode(entries)
+	case "html":
+		w.Header().Set("Content-type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		return listingTemplate.Execute(w, map[string]interface{}{
+			"Path": req.URL.Path,
+			"Entries": linkedEntries(req.URL.Path, entries),
+		})
+	}
+
+	w.Header().Set("Content-type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	for _, entry := range entries {
+		_, err := w.Write([]byte(entry.Name + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,498 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"s3proxy/blob_cache"
+	"s3proxy/context"
+	"s3proxy/source"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"golang.org/x/net/context"
+)
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// S3Api speaks enough of the S3 REST protocol for the aws CLI and SDKs to use
+// the proxy as an endpoint. Objects are served through the same cache as the
+// plain proxy.
+type S3Api struct {
+	proxy  *S3Proxy
+	domain string
+}
+
+// NewS3Api creates the S3 front-end. If domain is set, requests for hosts of
+// the form <bucket>.<domain> are treated as virtual-hosted-style requests.
+func NewS3Api(c blob_cache.BlobCache, domain string) *S3Api {
+	return &S3Api{
+		proxy: NewS3Proxy(c),
+		domain: strings.ToLower(domain),
+	}
+}
+
+// SetWritable allows PutObject and multipart uploads. Without it the API is
+// read-only.
+func (this *S3Api) SetWritable(writable bool) {
+	this.proxy.SetWritable(writable)
+}
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestId string   `xml:"RequestId"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResultV1 struct {
+	XMLName        xml.Name         `xml:"ListBucketResult"`
+	Xmlns          string           `xml:"xmlns,attr"`
+	Name           string           `xml:"Name"`
+	Prefix         string           `xml:"Prefix"`
+	Marker         string           `xml:"Marker"`
+	NextMarker     string           `xml:"NextMarker,omitempty"`
+	MaxKeys        int64            `xml:"MaxKeys"`
+	Delimiter      string           `xml:"Delimiter,omitempty"`
+	EncodingType   string           `xml:"EncodingType,omitempty"`
+	IsTruncated    bool             `xml:"IsTruncated"`
+	Contents       []s3Object       `xml:"Contents"`
+	CommonPrefixes []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type listBucketResultV2 struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int              `xml:"KeyCount"`
+	MaxKeys               int64            `xml:"MaxKeys"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3Version struct {
+	Key          string `xml:"Key"`
+	VersionId    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3DeleteMarker struct {
+	Key          string `xml:"Key"`
+	VersionId    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+}
+
+type listVersionsResult struct {
+	XMLName             xml.Name         `xml:"ListVersionsResult"`
+	Xmlns               string           `xml:"xmlns,attr"`
+	Name                string           `xml:"Name"`
+	Prefix              string           `xml:"Prefix"`
+	KeyMarker           string           `xml:"KeyMarker"`
+	VersionIdMarker     string           `xml:"VersionIdMarker"`
+	NextKeyMarker       string           `xml:"NextKeyMarker,omitempty"`
+	NextVersionIdMarker string           `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int64            `xml:"MaxKeys"`
+	Delimiter           string           `xml:"Delimiter,omitempty"`
+	EncodingType        string           `xml:"EncodingType,omitempty"`
+	IsTruncated         bool             `xml:"IsTruncated"`
+	Versions            []s3Version      `xml:"Version"`
+	DeleteMarkers       []s3DeleteMarker `xml:"DeleteMarker"`
+	CommonPrefixes      []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   struct {
+		ID          string `xml:"ID"`
+		DisplayName string `xml:"DisplayName"`
+	} `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+func (this *S3Api) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	counter := atomic.AddUint64(&requestCounter, 1)
+	ctxValue := &cache_context.Context {
+		Sequence: counter,
+		CacheControl: requestCacheControl(req),
+	}
+	ctx := context.WithValue(req.Context(), 0, ctxValue)
+
+	bucket, key := this.bucketAndKey(req)
+	log.Infof("[%d] S3 API %s bucket='%s' key='%s'", counter, req.Method, bucket, key)
+
+	switch {
+	case bucket == "" && req.Method == "GET":
+		this.listBuckets(w, req, counter)
+	case bucket == "":
+		writeS3ErrorCode(w, req, counter, http.StatusMethodNotAllowed, "MethodNotAllowed",
+			"The specified method is not allowed against this resource.")
+	case key == "" && (req.Method == "GET" || req.Method == "HEAD"):
+		this.listObjects(ctx, w, req, bucket)
+	case key == "":
+		writeS3ErrorCode(w, req, counter, http.StatusNotImplemented, "NotImplemented",
+			"A header you provided implies functionality that is not implemented.")
+	case req.Method == "GET":
+		this.proxy.serveObject(ctx, w, req, versionedUri(req, "/" + bucket + "/" + key), s3ErrorWriter(req))
+	case req.Method == "HEAD":
+		this.proxy.serveMeta(ctx, w, req, versionedUri(req, "/" + bucket + "/" + key), s3ErrorWriter(req))
+	case !this.proxy.writable:
+		writeS3ErrorCode(w, req, counter, http.StatusMethodNotAllowed, "MethodNotAllowed",
+			"The specified method is not allowed against this resource.")
+	case unsupportedUploadHeader(req) != "":
+		log.Infof("[%d] Refusing upload with %s", counter, unsupportedUploadHeader(req))
+		writeS3ErrorCode(w, req, counter, http.StatusNotImplemented, "NotImplemented",
+			"A header you provided implies functionality that is not implemented.")
+	case req.Method == "PUT" && req.URL.Query().Get("uploadId") != "":
+		this.uploadPart(ctx, w, req, bucket, key)
+	case req.Method == "PUT":
+		opts := uploadOptions(req)
+		this.proxy.putObject(ctx, w, req, "/" + bucket + "/" + key, uploadBody(req, opts), opts, s3ErrorWriter(req))
+	case req.Method == "POST" && hasParam(req, "uploads"):
+		this.createMultipartUpload(ctx, w, req, bucket, key)
+	case req.Method == "POST" && req.URL.Query().Get("uploadId") != "":
+		this.completeMultipartUpload(ctx, w, req, bucket, key)
+	case req.Method == "DELETE" && req.URL.Query().Get("uploadId") != "":
+		this.abortMultipartUpload(ctx, w, req, bucket, key)
+	default:
+		writeS3ErrorCode(w, req, counter, http.StatusNotImplemented, "NotImplemented",
+			"A header you provided implies functionality that is not implemented.")
+	}
+}
+
+// bucketAndKey extracts the bucket and key from either a virtual-hosted-style
+// or a path-style request.
+func (this *S3Api) bucketAndKey(req *http.Request) (string, string) {
+	host := strings.ToLower(req.Host)
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+
+	if this.domain != "" && strings.HasSuffix(host, "." + this.domain) {
+		bucket := strings.TrimSuffix(host, "." + this.domain)
+		return bucket, strings.TrimPrefix(req.URL.Path, "/")
+	}
+
+	p := strings.TrimPrefix(req.URL.Path, "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+func (this *S3Api) listBuckets(w http.ResponseWriter, req *http.Request, counter uint64) {
+	buckets, err := this.proxy.cache.Buckets()
+	if err != nil {
+		writeS3Error(w, req, counter, err)
+		return
+	}
+
+	result := &listAllMyBucketsResult{
+		Xmlns: s3Namespace,
+	}
+	result.Owner.ID = "s3proxy"
+	result.Owner.DisplayName = "s3proxy"
+
+	for _, b := range buckets {
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name: b.Name,
+			CreationDate: formatS3Time(b.CreationDate),
+		})
+	}
+
+	writeXml(w, http.StatusOK, result)
+}
+
+func (this *S3Api) listObjects(ctx context.Context, w http.ResponseWriter, req *http.Request, bucket string) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+	query := req.URL.Query()
+
+	maxKeys := int64(1000)
+	if mk := query.Get("max-keys"); mk != "" {
+		n, err := strconv.ParseInt(mk, 10, 64)
+		if err != nil || n < 0 {
+			writeS3ErrorCode(w, req, counter, http.StatusBadRequest, "InvalidArgument",
+				"Provided max-keys not an integer or within integer range")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	encode := func(s string) string { return s }
+	encodingType := query.Get("encoding-type")
+	if encodingType == "url" {
+		encode = url.QueryEscape
+	}
+
+	v2 := query.Get("list-type") == "2"
+	versions := hasParam(req, "versions")
+
+	opts := &source.ListOptions{
+		Prefix: query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		MaxKeys: maxKeys,
+		Versions: versions,
+	}
+	if versions {
+		opts.StartAfter = query.Get("key-marker")
+		opts.VersionIdMarker = query.Get("version-id-marker")
+	} else if v2 {
+		opts.ContinuationToken = query.Get("continuation-token")
+		opts.StartAfter = query.Get("start-after")
+	} else {
+		opts.StartAfter = query.Get("marker")
+	}
+
+	var listing *source.ObjectListing
+	if maxKeys == 0 {
+		listing = &source.ObjectListing{}
+	} else {
+		var err error
+		listing, err = this.proxy.cache.List(ctx, bucket, opts)
+		if err != nil {
+			writeS3Error(w, req, counter, err)
+			return
+		}
+	}
+	writeCacheStatus(ctx, w)
+
+	var contents []s3Object
+	for _, obj := range listing.Objects {
+		contents = append(contents, s3Object{
+			Key: encode(obj.Key),
+			LastModified: formatS3Time(obj.LastModified),
+			ETag: obj.ETag,
+			Size: obj.Size,
+			StorageClass: obj.StorageClass,
+		})
+	}
+
+	var prefixes []s3CommonPrefix
+	for _, p := range listing.CommonPrefixes {
+		prefixes = append(prefixes, s3CommonPrefix{encode(p)})
+	}
+
+	if req.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if versions {
+		writeVersions(w, bucket, opts, listing, prefixes, encode, encodingType)
+		return
+	}
+
+	if v2 {
+		writeXml(w, http.StatusOK, &listBucketResultV2{
+			Xmlns: s3Namespace,
+			Name: bucket,
+			Prefix: encode(opts.Prefix),
+			StartAfter: encode(opts.StartAfter),
+			ContinuationToken: opts.ContinuationToken,
+			NextContinuationToken: listing.NextContinuationToken,
+			KeyCount: len(contents) + len(prefixes),
+			MaxKeys: maxKeys,
+			Delimiter: encode(opts.Delimiter),
+			EncodingType: encodingType,
+			IsTruncated: listing.IsTruncated,
+			Contents: contents,
+			CommonPrefixes: prefixes,
+		})
+		return
+	}
+
+	// V1 listings page by marker, which is simply the last key or prefix
+	// returned.
+	nextMarker := ""
+	if listing.IsTruncated {
+		if n := len(listing.Objects); n > 0 {
+			nextMarker = listing.Objects[n-1].Key
+		}
+		if n := len(listing.CommonPrefixes); n > 0 && listing.CommonPrefixes[n-1] > nextMarker {
+			nextMarker = listing.CommonPrefixes[n-1]
+		}
+	}
+
+	writeXml(w, http.StatusOK, &listBucketResultV1{
+		Xmlns: s3Namespace,
+		Name: bucket,
+		Prefix: encode(opts.Prefix),
+		Marker: encode(opts.StartAfter),
+		NextMarker: encode(nextMarker),
+		MaxKeys: maxKeys,
+		Delimiter: encode(opts.Delimiter),
+		EncodingType: encodingType,
+		IsTruncated: listing.IsTruncated,
+		Contents: contents,
+		CommonPrefixes: prefixes,
+	})
+}
+
+// writeVersions writes a listing of versions in the form of ListObjectVersions.
+func writeVersions(w http.ResponseWriter, bucket string, opts *source.ListOptions, listing *source.ObjectListing,
+		prefixes []s3CommonPrefix, encode func(string) string, encodingType string) {
+	result := &listVersionsResult{
+		Xmlns: s3Namespace,
+		Name: bucket,
+		Prefix: encode(opts.Prefix),
+		KeyMarker: encode(opts.StartAfter),
+		VersionIdMarker: opts.VersionIdMarker,
+		NextKeyMarker: encode(listing.NextKeyMarker),
+		NextVersionIdMarker: listing.NextVersionIdMarker,
+		MaxKeys: opts.MaxKeys,
+		Delimiter: encode(opts.Delimiter),
+		EncodingType: encodingType,
+		IsTruncated: listing.IsTruncated,
+		CommonPrefixes: prefixes,
+	}
+
+	for _, obj := range listing.Objects {
+		if obj.DeleteMarker {
+			result.DeleteMarkers = append(result.DeleteMarkers, s3DeleteMarker{
+				Key: encode(obj.Key),
+				VersionId: obj.VersionId,
+				IsLatest: obj.IsLatest,
+				LastModified: formatS3Time(obj.LastModified),
+			})
+			continue
+		}
+		result.Versions = append(result.Versions, s3Version{
+			Key: encode(obj.Key),
+			VersionId: obj.VersionId,
+			IsLatest: obj.IsLatest,
+			LastModified: formatS3Time(obj.LastModified),
+			ETag: obj.ETag,
+			Size: obj.Size,
+			StorageClass: obj.StorageClass,
+		})
+	}
+
+	writeXml(w, http.StatusOK, result)
+}
+
+func formatS3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func writeXml(w http.ResponseWriter, code int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		log.Errorf("Unable to marshal XML response: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/xml")
+	w.Header().Set("Content-length", fmt.Sprintf("%d", len(xml.Header) + len(body)))
+	w.WriteHeader(code)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func s3ErrorWriter(req *http.Request) errorWriter {
+	return func(w http.ResponseWriter, counter uint64, err error) {
+		writeS3Error(w, req, counter, err)
+	}
+}
+
+// writeS3Error maps an upstream error onto the S3 error it most resembles.
+func writeS3Error(w http.ResponseWriter, req *http.Request, counter uint64, err error) {
+	code := http.StatusInternalServerError
+	s3Code := "InternalError"
+	message := "We encountered an internal error. Please try again."
+
+	if err == blob_cache.ErrOffline {
+		code = http.StatusGatewayTimeout
+		s3Code = "GatewayTimeout"
+		message = "The object is not cached and the proxy is offline."
+	} else if err == blob_cache.ErrNotCached {
+		code = http.StatusGatewayTimeout
+		s3Code = "GatewayTimeout"
+		message = "The object is not cached."
+	} else if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "NotFound", "NoSuchKey":
+			code = http.StatusNotFound
+			s3Code = "NoSuchKey"
+			message = "The specified key does not exist."
+		case "NoSuchBucket":
+			code = http.StatusNotFound
+			s3Code = "NoSuchBucket"
+			message = "The specified bucket does not exist."
+		case "NoSuchUpload":
+			code = http.StatusNotFound
+			s3Code = "NoSuchUpload"
+			message = "The specified upload does not exist."
+		case "NoSuchVersion":
+			code = http.StatusNotFound
+			s3Code = "NoSuchVersion"
+			message = "The specified version does not exist."
+		case "Forbidden", "AccessDenied":
+			code = http.StatusForbidden
+			s3Code = "AccessDenied"
+			message = "Access Denied"
+		default:
+			if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() < 500 {
+				code = reqErr.StatusCode()
+				s3Code = awsErr.Code()
+				message = awsErr.Message()
+			}
+			log.Errorf("[%d] AWS Unclassified error: %+v", counter, awsErr)
+		}
+	} else {
+		log.Errorf("[%d] ERROR: %+v", counter, err)
+	}
+
+	writeS3ErrorCode(w, req, counter, code, s3Code, message)
+}
+
+func writeS3ErrorCode(w http.ResponseWriter, req *http.Request, counter uint64, code int, s3Code string, message string) {
+	// Responses to HEAD requests cannot carry a body
+	if req.Method == "HEAD" {
+		w.WriteHeader(code)
+		return
+	}
+
+	writeXml(w, code, &s3Error{
+		Code: s3Code,
+		Message: message,
+		Resource: req.URL.Path,
+		RequestId: strconv.FormatUint(counter, 10),
+	})
+}
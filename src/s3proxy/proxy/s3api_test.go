@@ -0,0 +1,395 @@
+package proxy_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"io/ioutil"
+	"s3proxy/fakes"
+	"s3proxy/proxy"
+	"s3proxy/blob_cache"
+	"s3proxy/source"
+	"os"
+	"strings"
+	"time"
+	"github.com/karlseguin/ccache"
+)
+
+type listResult struct {
+	Name                  string
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key  string
+		Size int64
+		ETag string
+	}
+	CommonPrefixes        []struct {
+		Prefix string
+	}
+}
+
+type versionsResult struct {
+	Name     string
+	Versions []struct {
+		Key       string
+		VersionId string
+		IsLatest  bool
+	} `xml:"Version"`
+}
+
+type errorResult struct {
+	Code string
+}
+
+var _ = Describe("S3 API", func() {
+	var cacheDir string
+	var fus *fakes.FakeUpstreamSource
+	var cache *blob_cache.S3Cache
+	var api *proxy.S3Api
+
+	BeforeEach(func() {
+		var err error
+		cacheDir, err = ioutil.TempDir("", "cached-")
+		Expect(err).To(BeNil())
+
+		bc := ccache.Layered(ccache.Configure())
+		fus = fakes.NewFakeUpstreamSource(cacheDir, bc)
+		fus.Objects["test_bucket"] = []string{"10", "dir/20", "dir/30", "other/5"}
+		cache = blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+		api = proxy.NewS3Api(cache, "s3.local")
+		api.SetWritable(true)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(cacheDir)
+	})
+
+	It("serves path-style GetObject", func() {
+		req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Header().Get("ETag")).ToNot(BeEmpty())
+		Expect(rr.Body.String()).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+	})
+
+	It("serves virtual-hosted-style GetObject", func() {
+		req, err := http.NewRequest("GET", "http://test_bucket.s3.local:9000/10", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+	})
+
+	It("serves HeadObject", func() {
+		req, err := http.NewRequest("HEAD", "/test_bucket/10", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Header().Get("Content-length")).To(Equal("20"))
+		Expect(rr.Body.Len()).To(Equal(0))
+	})
+
+	It("lists objects with ListObjectsV2", func() {
+		req, err := http.NewRequest("GET", "/test_bucket?list-type=2&delimiter=/", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+
+		result := &listResult{}
+		Expect(xml.Unmarshal(rr.Body.Bytes(), result)).To(Succeed())
+		Expect(result.Name).To(Equal("test_bucket"))
+		Expect(result.KeyCount).To(Equal(3))
+		Expect(result.Contents).To(HaveLen(1))
+		Expect(result.Contents[0].Key).To(Equal("10"))
+		Expect(result.Contents[0].Size).To(Equal(int64(20)))
+		Expect(result.CommonPrefixes).To(HaveLen(2))
+		Expect(result.CommonPrefixes[0].Prefix).To(Equal("dir/"))
+	})
+
+	It("pages through ListObjectsV2 results", func() {
+		req, err := http.NewRequest("GET", "/test_bucket?list-type=2&max-keys=2", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+
+		result := &listResult{}
+		Expect(xml.Unmarshal(rr.Body.Bytes(), result)).To(Succeed())
+		Expect(result.IsTruncated).To(BeTrue())
+		Expect(result.Contents).To(HaveLen(2))
+
+		req, err = http.NewRequest("GET", "/test_bucket?list-type=2&max-keys=2&continuation-token=" + result.NextContinuationToken, nil)
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+
+		result = &listResult{}
+		Expect(xml.Unmarshal(rr.Body.Bytes(), result)).To(Succeed())
+		Expect(result.IsTruncated).To(BeFalse())
+		Expect(result.Contents).To(HaveLen(2))
+		Expect(result.Contents[1].Key).To(Equal("other/5"))
+	})
+
+	It("marks listings served stale", func() {
+		cache.SetListingTTL(time.Millisecond)
+		req, err := http.NewRequest("GET", "/test_bucket?list-type=2", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Header().Get("X-Cache")).To(BeEmpty())
+
+		time.Sleep(10 * time.Millisecond)
+		fus.SetUnavailable(true)
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Header().Get("X-Cache")).To(Equal("STALE"))
+	})
+
+	It("serves versions of objects", func() {
+		fus.Versions["/test_bucket/10"] = []string{"v2", "v1"}
+
+		req, err := http.NewRequest("GET", "/test_bucket/10?versionId=v1", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Header().Get("x-amz-version-id")).To(Equal("v1"))
+		Expect(rr.Body.String()).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+
+		req, err = http.NewRequest("GET", "/test_bucket/10?versionId=v9", nil)
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusNotFound))
+
+		result := &errorResult{}
+		Expect(xml.Unmarshal(rr.Body.Bytes(), result)).To(Succeed())
+		Expect(result.Code).To(Equal("NoSuchVersion"))
+	})
+
+	It("lists object versions", func() {
+		fus.Versions["/test_bucket/10"] = []string{"v2", "v1"}
+
+		req, err := http.NewRequest("GET", "/test_bucket?versions&prefix=1", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+
+		result := &versionsResult{}
+		Expect(xml.Unmarshal(rr.Body.Bytes(), result)).To(Succeed())
+		Expect(result.Name).To(Equal("test_bucket"))
+		Expect(result.Versions).To(HaveLen(2))
+		Expect(result.Versions[0].VersionId).To(Equal("v2"))
+		Expect(result.Versions[0].IsLatest).To(BeTrue())
+		Expect(result.Versions[1].VersionId).To(Equal("v1"))
+		Expect(result.Versions[1].IsLatest).To(BeFalse())
+	})
+
+	It("lists buckets", func() {
+		req, err := http.NewRequest("GET", "/", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(ContainSubstring("<Name>test_bucket</Name>"))
+	})
+
+	It("returns S3 style errors", func() {
+		req, err := http.NewRequest("GET", "/no_bucket?list-type=2", nil)
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusNotFound))
+
+		result := &errorResult{}
+		Expect(xml.Unmarshal(rr.Body.Bytes(), result)).To(Succeed())
+		Expect(result.Code).To(Equal("NoSuchBucket"))
+
+		req, err = http.NewRequest("PATCH", "/test_bucket/10", nil)
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusNotImplemented))
+	})
+
+	It("writes objects through with PutObject", func() {
+		req, err := http.NewRequest("PUT", "/test_bucket/uploaded", strings.NewReader("hello world"))
+		Expect(err).To(BeNil())
+		req.Header.Set("Content-Type", "text/plain")
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Header().Get("ETag")).ToNot(BeEmpty())
+
+		req, err = http.NewRequest("GET", "/test_bucket/uploaded", nil)
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(Equal("hello world"))
+		Expect(fus.GetCount).To(Equal(int32(0)))
+	})
+
+	It("refuses writes unless they are enabled", func() {
+		api = proxy.NewS3Api(cache, "s3.local")
+
+		req, err := http.NewRequest("PUT", "/test_bucket/uploaded", strings.NewReader("hello world"))
+		Expect(err).To(BeNil())
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusMethodNotAllowed))
+
+		req, err = http.NewRequest("POST", "/test_bucket/uploaded?uploads", nil)
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(fus.PutCount).To(Equal(int32(0)))
+	})
+
+	It("passes the ACL, encryption, tags and Content-MD5 of uploads on", func() {
+		req, err := http.NewRequest("PUT", "/test_bucket/uploaded", strings.NewReader("hello world"))
+		Expect(err).To(BeNil())
+		req.Header.Set("x-amz-acl", "private")
+		req.Header.Set("x-amz-server-side-encryption", "aws:kms")
+		req.Header.Set("x-amz-server-side-encryption-aws-kms-key-id", "key")
+		req.Header.Set("x-amz-tagging", "a=b")
+		req.Header.Set("Content-MD5", "XrY7u+Ae7tCTyyK7j1rNww==")
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(fus.UploadOptions["/test_bucket/uploaded"]).To(Equal(&source.UploadOptions{
+			ACL: "private",
+			ServerSideEncryption: "aws:kms",
+			SSEKMSKeyId: "key",
+			Tagging: "a=b",
+			ContentMD5: "XrY7u+Ae7tCTyyK7j1rNww==",
+		}))
+	})
+
+	It("refuses uploads with headers which can't be passed on", func() {
+		for _, header := range []string{"x-amz-server-side-encryption-customer-key", "x-amz-grant-read"} {
+			req, err := http.NewRequest("PUT", "/test_bucket/uploaded", strings.NewReader("hello world"))
+			Expect(err).To(BeNil())
+			req.Header.Set(header, "x")
+
+			rr := httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusNotImplemented))
+		}
+		Expect(fus.PutCount).To(Equal(int32(0)))
+	})
+
+	It("decodes aws-chunked uploads", func() {
+		body := "5;chunk-signature=abc\r\nhello\r\n6;chunk-signature=def\r\n world\r\n0;chunk-signature=ghi\r\nx-amz-checksum-crc32:AAAA\r\n\r\n"
+		req, err := http.NewRequest("PUT", "/test_bucket/uploaded", strings.NewReader(body))
+		Expect(err).To(BeNil())
+		req.Header.Set("Content-Encoding", "aws-chunked")
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+
+		req, err = http.NewRequest("GET", "/test_bucket/uploaded", nil)
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Body.String()).To(Equal("hello world"))
+		Expect(rr.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(fus.UploadOptions["/test_bucket/uploaded"].Checksums).To(Equal(map[string]string{"x-amz-checksum-crc32": "AAAA"}))
+	})
+
+	It("passes the checksums of uploads on", func() {
+		req, err := http.NewRequest("PUT", "/test_bucket/uploaded", strings.NewReader("hello world"))
+		Expect(err).To(BeNil())
+		req.Header.Set("x-amz-sdk-checksum-algorithm", "CRC32")
+		req.Header.Set("x-amz-checksum-crc32", "DUoRhQ==")
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(fus.UploadOptions["/test_bucket/uploaded"].Checksums).To(Equal(map[string]string{"x-amz-checksum-crc32": "DUoRhQ=="}))
+	})
+
+	It("writes objects through with multipart uploads", func() {
+		req, err := http.NewRequest("POST", "/test_bucket/uploaded?uploads", nil)
+		Expect(err).To(BeNil())
+		req.Header.Set("x-amz-tagging", "a=b")
+
+		rr := httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(fus.UploadOptions["/test_bucket/uploaded"].Tagging).To(Equal("a=b"))
+
+		initiated := &struct{ UploadId string }{}
+		Expect(xml.Unmarshal(rr.Body.Bytes(), initiated)).To(Succeed())
+		Expect(initiated.UploadId).ToNot(BeEmpty())
+
+		var etags []string
+		for i, part := range []string{"hello", " world"} {
+			req, err = http.NewRequest("PUT", fmt.Sprintf("/test_bucket/uploaded?partNumber=%d&uploadId=%s", i + 1, initiated.UploadId), strings.NewReader(part))
+			Expect(err).To(BeNil())
+
+			rr = httptest.NewRecorder()
+			api.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			etags = append(etags, rr.Header().Get("ETag"))
+		}
+
+		complete := fmt.Sprintf("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag><ChecksumCRC32>NhCmhg==</ChecksumCRC32></Part>" +
+			"<Part><PartNumber>2</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>", etags[0], etags[1])
+		req, err = http.NewRequest("POST", "/test_bucket/uploaded?uploadId=" + initiated.UploadId, strings.NewReader(complete))
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(ContainSubstring("<CompleteMultipartUploadResult"))
+		Expect(fus.CompletedParts["/test_bucket/uploaded"]).To(Equal([]source.CompletedPart{
+			{PartNumber: 1, ETag: etags[0], Checksums: map[string]string{"ChecksumCRC32": "NhCmhg=="}},
+			{PartNumber: 2, ETag: etags[1]},
+		}))
+
+		req, err = http.NewRequest("GET", "/test_bucket/uploaded", nil)
+		Expect(err).To(BeNil())
+
+		rr = httptest.NewRecorder()
+		api.ServeHTTP(rr, req)
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(Equal("hello world"))
+		Expect(fus.GetCount).To(Equal(int32(0)))
+	})
+})
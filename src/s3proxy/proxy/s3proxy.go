@@ -9,20 +9,31 @@ import (
 	"github.com/op/go-logging"
 	"strings"
 	"net"
+	"mime/multipart"
+	"net/textproto"
+	"time"
+	"s3proxy/source"
 	"sync/atomic"
 	"s3proxy/context"
 	"golang.org/x/net/context"
 )
 
 type S3Proxy struct {
-	cache blob_cache.BlobCache
+	cache    blob_cache.BlobCache
+	writable bool
 }
 
 var requestCounter uint64
 var log = logging.MustGetLogger("s3proxy")
 
 func NewS3Proxy(c blob_cache.BlobCache) *S3Proxy {
-	return &S3Proxy{c}
+	return &S3Proxy{cache: c}
+}
+
+// SetWritable allows uploads to be written through to S3. Without it the
+// proxy is read-only.
+func (this *S3Proxy) SetWritable(writable bool) {
+	this.writable = writable
 }
 
 func (this *S3Proxy) Handler(w http.ResponseWriter, req *http.Request) {
@@ -32,67 +43,392 @@ func (this *S3Proxy) Handler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Create a simple context to pass down to other functions
+	// Create a simple context to pass down to other functions. It ends when the
+	// client goes away, so that nothing is left waiting on its behalf.
 	counter := atomic.AddUint64(&requestCounter, 1)
 	ctxValue := &cache_context.Context {
 		Sequence: counter,
+		CacheControl: requestCacheControl(req),
 	}
-	ctx := context.WithValue(context.Background(), 0, ctxValue)
+	ctx := context.WithValue(req.Context(), 0, ctxValue)
 
 	log.Infof("[%d] Requesting %s", counter, req.URL.Path)
 
 	if strings.HasSuffix(req.URL.Path, "/") {
-		dirs, err := this.cache.Directory(req.URL.Path)
+		entries, err := this.cache.Directory(ctx, req.URL.Path)
 		if err != nil {
 			log.Errorf("[%d] Unable to return directory: %s", counter, err)
+			writeError(w, counter, err)
+			return
 		}
+		writeCacheStatus(ctx, w)
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-type", "text/plain")
-		for _, dir := range dirs {
-			w.Write([]byte(dir))
-			w.Write([]byte("\n"))
+		err = writeListing(w, req, entries)
+		if err != nil {
+			log.Errorf("[%d] Error writing directory: %s", counter, err)
 		}
 		return
 	}
 
-	r, err := this.cache.Get(ctx, req.URL.Path)
+	this.serveObject(ctx, w, req, versionedUri(req, req.URL.Path), writeError)
+}
+
+// errorWriter turns an error from the cache into a response.
+type errorWriter func(w http.ResponseWriter, counter uint64, err error)
+
+// serveObject streams an object, or the requested ranges of it, to the client.
+func (this *S3Proxy) serveObject(ctx context.Context, w http.ResponseWriter, req *http.Request, uri string, onError errorWriter) {
+	ctxValue := ctx.Value(0).(*cache_context.Context)
+	counter := ctxValue.Sequence
+
+	// Answer conditional requests for fresh objects straight from the meta,
+	// without touching the block cache, unless the request has its own
+	// cache directives.
+	if meta := this.cache.GetMeta(uri); meta != nil && meta.Expires.After(time.Now()) && ctxValue.CacheControl == "" {
+		if this.respondToPreconditions(w, req, meta) {
+			return
+		}
+	}
+
+	r, err := this.cache.Get(ctx, uri)
 	defer r.Close()
 
 	if err != nil {
-		code := http.StatusInternalServerError
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == "NotFound" || awsErr.Code() == "NoSuchKey" {
-				code = http.StatusNotFound
-			} else {
-				log.Errorf("[%d] AWS Unclassified error: %+v", counter, awsErr)
+		onError(w, counter, err)
+		return
+	}
+	writeCacheStatus(ctx, w)
+
+	contentType := ""
+	rangeHeader := req.Header.Get("Range")
+	meta := this.cache.GetMeta(uri)
+	if meta != nil {
+		if this.respondToPreconditions(w, req, meta) {
+			return
+		}
+		if !checkIfRange(req, meta) {
+			rangeHeader = ""
+		}
+
+		contentType = meta.ContentType
+		w.Header().Set("Content-type", contentType)
+		writeObjectHeaders(w, meta)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	size := r.Size()
+	var ranges []byteRange
+	if rangeHeader != "" {
+		ranges, err = parseRange(rangeHeader, size)
+		if err == errUnsatisfiableRange {
+			log.Infof("[%d] Rejecting range '%s' for %s: %s", counter, rangeHeader, uri, err)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		// RFC 7233: a Range header which can't be parsed is ignored
+		if err != nil {
+			log.Infof("[%d] Ignoring range '%s' for %s: %s", counter, rangeHeader, uri, err)
+		}
+	}
+
+	// Send the whole object without any ranges, and don't let a client turn a
+	// request into more work than just sending the whole object.
+	if len(ranges) == 0 || sumRangesSize(ranges) > size {
+		w.Header().Set("Content-length", fmt.Sprintf("%d", size))
+		_, err = io.Copy(w, r)
+		this.checkStreamError(ctx, uri, err)
+		return
+	}
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		w.Header().Set("Content-Range", ra.contentRange(size))
+		w.Header().Set("Content-length", fmt.Sprintf("%d", ra.length))
+		w.WriteHeader(http.StatusPartialContent)
+
+		_, err = r.Seek(ra.start, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(w, r, ra.length)
+		}
+		this.checkStreamError(ctx, uri, err)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-type", "multipart/byteranges; boundary=" + mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {ra.contentRange(size)},
+			"Content-Type":  {contentType},
+		})
+		if err == nil {
+			_, err = r.Seek(ra.start, io.SeekStart)
+		}
+		if err == nil {
+			_, err = io.CopyN(part, r, ra.length)
+		}
+		if err != nil {
+			this.checkStreamError(ctx, uri, err)
+			return
+		}
+	}
+	mw.Close()
+}
+
+// Head answers from the cached meta, or the upstream meta, without ever
+// downloading the object itself.
+func (this *S3Proxy) Head(w http.ResponseWriter, req *http.Request) {
+	counter := atomic.AddUint64(&requestCounter, 1)
+	ctxValue := &cache_context.Context {
+		Sequence: counter,
+		CacheControl: requestCacheControl(req),
+	}
+	ctx := context.WithValue(req.Context(), 0, ctxValue)
+
+	log.Infof("[%d] Head %s", counter, req.URL.Path)
+
+	if strings.HasSuffix(req.URL.Path, "/") {
+		w.Header().Set("Content-type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	this.serveMeta(ctx, w, req, versionedUri(req, req.URL.Path), writeError)
+}
+
+// serveMeta answers a HEAD request.
+func (this *S3Proxy) serveMeta(ctx context.Context, w http.ResponseWriter, req *http.Request, uri string, onError errorWriter) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+
+	meta, err := this.cache.Stat(ctx, uri)
+	if err != nil {
+		onError(w, counter, err)
+		return
+	}
+	writeCacheStatus(ctx, w)
+
+	if this.respondToPreconditions(w, req, meta) {
+		return
+	}
+
+	w.Header().Set("Content-type", meta.ContentType)
+	writeObjectHeaders(w, meta)
+	w.Header().Set("Content-length", fmt.Sprintf("%d", meta.Size))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Put writes an object through to S3. It is cached on the way, so reading it
+// back is a cache hit.
+func (this *S3Proxy) Put(w http.ResponseWriter, req *http.Request) {
+	counter := atomic.AddUint64(&requestCounter, 1)
+	ctxValue := &cache_context.Context {
+		Sequence: counter,
+	}
+	ctx := context.WithValue(req.Context(), 0, ctxValue)
+
+	log.Infof("[%d] Put %s", counter, req.URL.Path)
+
+	if !this.writable {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if header := unsupportedUploadHeader(req); header != "" {
+		log.Infof("[%d] Refusing upload with %s", counter, header)
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	this.putObject(ctx, w, req, req.URL.Path, req.Body, uploadOptions(req), writeError)
+}
+
+func (this *S3Proxy) putObject(ctx context.Context, w http.ResponseWriter, req *http.Request, uri string, body io.Reader, opts *source.UploadOptions, onError errorWriter) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+
+	meta, err := this.cache.Put(ctx, uri, body, requestMeta(req), opts)
+	if err != nil {
+		onError(w, counter, err)
+		return
+	}
+
+	w.Header().Set("ETag", meta.ETag)
+	if meta.VersionId != "" {
+		w.Header().Set("x-amz-version-id", meta.VersionId)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestMeta collects the headers of an upload which are stored with the
+// object.
+func requestMeta(req *http.Request) *source.Meta {
+	meta := &source.Meta{
+		ContentType: req.Header.Get("Content-Type"),
+		CacheControl: req.Header.Get("Cache-Control"),
+		ObjectHeaders: source.ObjectHeaders{
+			ContentEncoding: contentEncoding(req),
+			ContentDisposition: req.Header.Get("Content-Disposition"),
+			ContentLanguage: req.Header.Get("Content-Language"),
+			StorageClass: req.Header.Get("x-amz-storage-class"),
+		},
+	}
+
+	if expires, err := http.ParseTime(req.Header.Get("Expires")); err == nil {
+		meta.UpstreamExpires = expires
+	}
+
+	for name, values := range req.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") && len(values) > 0 {
+			if meta.UserMeta == nil {
+				meta.UserMeta = make(map[string]string)
 			}
+			meta.UserMeta[name[len("x-amz-meta-"):]] = values[0]
+		}
+	}
+
+	return meta
+}
+
+// uploadOptions collects the headers of an upload which are passed on to S3
+// but not stored with the object.
+func uploadOptions(req *http.Request) *source.UploadOptions {
+	opts := &source.UploadOptions{
+		ACL: req.Header.Get("x-amz-acl"),
+		ServerSideEncryption: req.Header.Get("x-amz-server-side-encryption"),
+		SSEKMSKeyId: req.Header.Get("x-amz-server-side-encryption-aws-kms-key-id"),
+		Tagging: req.Header.Get("x-amz-tagging"),
+		ContentMD5: req.Header.Get("Content-MD5"),
+	}
+
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-checksum-") && len(values) > 0 {
+			if opts.Checksums == nil {
+				opts.Checksums = make(map[string]string)
+			}
+			opts.Checksums[lower] = values[0]
+		}
+	}
+
+	return opts
+}
+
+// unsupportedUploadHeader returns a header of an upload which can't be passed
+// on to S3, if there is one, so that the upload is refused rather than
+// written without it. Customer-provided encryption keys aren't passed on
+// either, since the cached copy would then be served without the key.
+// x-amz-trailer and x-amz-sdk-checksum-algorithm only describe checksums,
+// which are passed on by themselves.
+func unsupportedUploadHeader(req *http.Request) string {
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		switch {
+		case lower == "x-amz-copy-source",
+			lower == "x-amz-server-side-encryption-context",
+			lower == "x-amz-server-side-encryption-bucket-key-enabled",
+			lower == "x-amz-website-redirect-location",
+			strings.HasPrefix(lower, "x-amz-server-side-encryption-customer-"),
+			strings.HasPrefix(lower, "x-amz-grant-"),
+			strings.HasPrefix(lower, "x-amz-object-lock-"):
+			return name
+		}
+	}
+	return ""
+}
+
+// versionedUri adds the version of an object asked for, if any, to its uri.
+func versionedUri(req *http.Request, uri string) string {
+	return source.VersionedUri(uri, req.URL.Query().Get("versionId"))
+}
+
+// requestCacheControl returns the Cache-Control sent with a request. An
+// HTTP/1.0 Pragma: no-cache is treated as no-cache.
+func requestCacheControl(req *http.Request) string {
+	cc := strings.Join(req.Header["Cache-Control"], ",")
+	if cc == "" && strings.EqualFold(req.Header.Get("Pragma"), "no-cache") {
+		return "no-cache"
+	}
+	return cc
+}
+
+// writeObjectHeaders passes on the headers set on the object in S3.
+func writeObjectHeaders(w http.ResponseWriter, meta *source.Meta) {
+	headers := map[string]string{
+		"Content-Encoding": meta.ContentEncoding,
+		"Content-Disposition": meta.ContentDisposition,
+		"Content-Language": meta.ContentLanguage,
+		"x-amz-storage-class": meta.StorageClass,
+		"x-amz-version-id": meta.VersionId,
+	}
+	for name, value := range meta.UserMeta {
+		headers["x-amz-meta-" + strings.ToLower(name)] = value
+	}
+
+	for name, value := range headers {
+		if value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+}
+
+// writeCacheStatus flags responses served from an expired entry.
+func writeCacheStatus(ctx context.Context, w http.ResponseWriter) {
+	if ctx.Value(0).(*cache_context.Context).Stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		w.Header().Set("X-Cache", "STALE")
+	}
+}
+
+func writeError(w http.ResponseWriter, counter uint64, err error) {
+	code := http.StatusInternalServerError
+	if err == blob_cache.ErrOffline || err == blob_cache.ErrNotCached {
+		code = http.StatusGatewayTimeout
+	} else if awsErr, ok := err.(awserr.Error); ok {
+		if awsErr.Code() == "NotFound" || awsErr.Code() == "NoSuchKey" || awsErr.Code() == "NoSuchBucket" || awsErr.Code() == "NoSuchVersion" {
+			code = http.StatusNotFound
 		} else {
-			log.Errorf("[%d] ERROR: %+v", counter, err)
+			log.Errorf("[%d] AWS Unclassified error: %+v", counter, awsErr)
 		}
-		w.WriteHeader(code)
-		return
+	} else {
+		log.Errorf("[%d] ERROR: %+v", counter, err)
 	}
+	w.WriteHeader(code)
+}
 
-	meta := this.cache.GetMeta(req.URL.Path)
-	if meta != nil {
-		w.Header().Set("Content-length", fmt.Sprintf("%d", meta.Size))
-		w.Header().Set("Content-type", meta.ContentType)
+// respondToPreconditions writes the validator headers and, if the request's
+// preconditions short-circuit it, the final status. It returns true if the
+// request has been fully answered.
+func (this *S3Proxy) respondToPreconditions(w http.ResponseWriter, req *http.Request, meta *source.Meta) bool {
+	writeValidators(w, meta)
+
+	code := checkPreconditions(req, meta)
+	if code == 0 {
+		return false
 	}
 
-	_, err = io.Copy(w, r)
+	w.WriteHeader(code)
+	return true
+}
+
+func (this *S3Proxy) checkStreamError(ctx context.Context, uri string, err error) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+
 	if err != nil {
 		// This is a bit messy, but we really don't care if the client aborted the
 		// connection. Other errors are assumed to be from the upstream side and
 		// thus result in the cache entry being removed.
-		if e, ok := err.(*net.OpError); ok {
+		if ctx.Err() != nil {
+			log.Infof("[%d] Stopped streaming %s: %s", counter, uri, ctx.Err())
+		} else if e, ok := err.(*net.OpError); ok {
 			if e.Op != "write" {
-				log.Errorf("[%d] Error streaming %s: %s", counter, req.URL.Path, e.Err)
-				this.cache.Delete(ctx, req.URL.Path)
+				log.Errorf("[%d] Error streaming %s: %s", counter, uri, e.Err)
+				this.cache.Delete(ctx, uri)
 			}
 		} else {
-			log.Errorf("[%d] Error streaming %s: %s", counter, req.URL.Path, err)
-			this.cache.Delete(ctx, req.URL.Path)
+			log.Errorf("[%d] Error streaming %s: %s", counter, uri, err)
+			this.cache.Delete(ctx, uri)
 		}
 	}
 }
@@ -102,10 +438,10 @@ func (this *S3Proxy) Delete(w http.ResponseWriter, req *http.Request) {
 	ctxValue := &cache_context.Context {
 		Sequence: counter,
 	}
-	ctx := context.WithValue(context.Background(), 0, ctxValue)
+	ctx := context.WithValue(req.Context(), 0, ctxValue)
 
 	uri := req.URL.Path
-	uri = strings.TrimPrefix(uri, "/admin")
+	uri = versionedUri(req, strings.TrimPrefix(uri, "/admin"))
 	log.Infof("[%d] Deleted: %s", counter, uri)
 
 	this.cache.Delete(ctx, uri)
@@ -10,9 +10,17 @@ import (
 	"s3proxy/proxy"
 	"s3proxy/blob_cache"
 	"os"
-	"path"
 	"github.com/op/go-logging"
 	"github.com/karlseguin/ccache"
+	"mime"
+	"encoding/json"
+	"fmt"
+	"s3proxy/source"
+	"mime/multipart"
+	"io"
+	"strings"
+	"time"
+	"golang.org/x/net/context"
 )
 
 var log = logging.MustGetLogger("s3proxy")
@@ -43,7 +51,7 @@ var _ = Describe("S3Proxy test suite", func() {
 			Expect(err).To(BeNil())
 			Expect(string(body)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
 
-			cachedData, err := ioutil.ReadFile(path.Join(cacheDir, "test_bucket", "10"))
+			cachedData, err := ioutil.ReadFile(source.CachePath(cacheDir, "/test_bucket/10"))
 			Expect(err).To(BeNil())
 			Expect(string(cachedData)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
 
@@ -73,7 +81,7 @@ var _ = Describe("S3Proxy test suite", func() {
 			Expect(err).To(BeNil())
 			Expect(string(body)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
 
-			cachedData, err := ioutil.ReadFile(path.Join(cacheDir, "test_bucket", "10"))
+			cachedData, err := ioutil.ReadFile(source.CachePath(cacheDir, "/test_bucket/10"))
 			Expect(err).To(BeNil())
 			Expect(string(cachedData)).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
 		})
@@ -152,15 +160,523 @@ var _ = Describe("S3Proxy test suite", func() {
 			Expect(err).To(BeNil())
 			Expect(len(body) < 3000000).To(BeTrue())
 
-			_, err = os.Stat(path.Join(cacheDir, "error", "500000"))
+			_, err = os.Stat(source.CachePath(cacheDir, "/error/500000"))
 			Expect(err).ToNot(BeNil())
 
-			_, err = os.Stat(path.Join(cacheDir, "error", "500000._meta_"))
-			Expect(err).ToNot(BeNil())
+			Expect(cache.IndexedMeta("/error/500000")).To(BeNil())
 
 			Expect(bc.Get("/error/500000", "0")).To(BeNil())
 		})
 
+		It("serves a single byte range", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+			Expect(err).To(BeNil())
+			req.Header.Set("Range", "bytes=4-9")
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusPartialContent))
+			Expect(rr.Header().Get("Content-Range")).To(Equal("bytes 4-9/20"))
+			Expect(rr.Header().Get("Content-length")).To(Equal("6"))
+			Expect(rr.Header().Get("Accept-Ranges")).To(Equal("bytes"))
+
+			body, err := ioutil.ReadAll(rr.Body)
+			Expect(err).To(BeNil())
+			Expect(string(body)).To(Equal("2 3 4 "))
+		})
+
+		It("serves multiple byte ranges", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+			Expect(err).To(BeNil())
+			req.Header.Set("Range", "bytes=0-1,-4")
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusPartialContent))
+
+			mediaType, params, err := mime.ParseMediaType(rr.Header().Get("Content-type"))
+			Expect(err).To(BeNil())
+			Expect(mediaType).To(Equal("multipart/byteranges"))
+
+			mr := multipart.NewReader(rr.Body, params["boundary"])
+
+			part, err := mr.NextPart()
+			Expect(err).To(BeNil())
+			Expect(part.Header.Get("Content-Range")).To(Equal("bytes 0-1/20"))
+			data, err := ioutil.ReadAll(part)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("0 "))
+
+			part, err = mr.NextPart()
+			Expect(err).To(BeNil())
+			Expect(part.Header.Get("Content-Range")).To(Equal("bytes 16-19/20"))
+			data, err = ioutil.ReadAll(part)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal("8 9 "))
+
+			_, err = mr.NextPart()
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("rejects unsatisfiable ranges", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+			Expect(err).To(BeNil())
+			req.Header.Set("Range", "bytes=50-60")
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusRequestedRangeNotSatisfiable))
+			Expect(rr.Header().Get("Content-Range")).To(Equal("bytes */20"))
+		})
+
+		It("stops waiting for an object when the client goes away", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			ctx, cancel := context.WithCancel(context.Background())
+			req, err := http.NewRequest("GET", "/slow/10", nil)
+			Expect(err).To(BeNil())
+			req = req.WithContext(ctx)
+
+			done := make(chan struct{})
+			go func() {
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				close(done)
+			}()
+
+			// The response has started, but the content hasn't arrived yet
+			time.Sleep(fakes.SlowGetDelay + 100 * time.Millisecond)
+			cancel()
+			Eventually(done, fakes.SlowGetDelay / 4).Should(BeClosed())
+
+			// The download carries on for whoever asks next
+			req, err = http.NewRequest("GET", "/slow/10", nil)
+			Expect(err).To(BeNil())
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("ignores malformed ranges", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			for _, header := range []string{"items=0-5", "bytes=5", "bytes=x-y", "bytes=5-2", "bytes="} {
+				req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+				Expect(err).To(BeNil())
+				req.Header.Set("Range", header)
+
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				Expect(rr.Code).To(Equal(http.StatusOK), header)
+				Expect(rr.Header().Get("Content-Range")).To(BeEmpty())
+				Expect(rr.Body.String()).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+			}
+		})
+
+		It("sends validators and answers conditional requests", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+			Expect(err).To(BeNil())
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+
+			etag := rr.Header().Get("ETag")
+			Expect(etag).ToNot(BeEmpty())
+			Expect(rr.Header().Get("Last-Modified")).To(Equal("Sat, 01 Apr 2017 12:00:00 GMT"))
+			Expect(rr.Header().Get("Cache-Control")).To(MatchRegexp(`^max-age=(59|60)$`))
+			Expect(rr.Header().Get("Expires")).ToNot(BeEmpty())
+
+			req.Header.Set("If-None-Match", etag)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusNotModified))
+			Expect(rr.Header().Get("ETag")).To(Equal(etag))
+			Expect(rr.Body.Len()).To(Equal(0))
+
+			req.Header.Del("If-None-Match")
+			req.Header.Set("If-Modified-Since", "Sat, 01 Apr 2017 12:00:00 GMT")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusNotModified))
+
+			req.Header.Set("If-Modified-Since", "Fri, 31 Mar 2017 12:00:00 GMT")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+
+			req.Header.Del("If-Modified-Since")
+			req.Header.Set("If-Match", `"not-the-etag"`)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusPreconditionFailed))
+
+			req.Header.Del("If-Match")
+			req.Header.Set("If-Unmodified-Since", "Fri, 31 Mar 2017 12:00:00 GMT")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusPreconditionFailed))
+		})
+
+		It("answers HEAD requests without downloading", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Head)
+			req, err := http.NewRequest("HEAD", "/test_bucket/10", nil)
+			Expect(err).To(BeNil())
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Header().Get("Content-length")).To(Equal("20"))
+			Expect(rr.Header().Get("ETag")).ToNot(BeEmpty())
+			Expect(rr.Body.Len()).To(Equal(0))
+
+			// A second HEAD is answered from the cached meta
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+
+			Expect(fus.GetMetaCount).To(Equal(int32(1)))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+
+			_, err = os.Stat(source.CachePath(cacheDir, "/test_bucket/10"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("writes PUT requests through and serves them from the cache", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+			p.SetWritable(true)
+
+			req, err := http.NewRequest("PUT", "/test_bucket/new", strings.NewReader("hello world"))
+			Expect(err).To(BeNil())
+			req.Header.Set("Content-Type", "text/plain")
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(p.Put).ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Header().Get("ETag")).ToNot(BeEmpty())
+
+			req, err = http.NewRequest("GET", "/test_bucket/new", nil)
+			Expect(err).To(BeNil())
+
+			rr = httptest.NewRecorder()
+			http.HandlerFunc(p.Handler).ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(Equal("hello world"))
+			Expect(fus.PutCount).To(Equal(int32(1)))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+		})
+
+		It("refuses PUT requests unless writes are enabled", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			req, err := http.NewRequest("PUT", "/test_bucket/new", strings.NewReader("hello world"))
+			Expect(err).To(BeNil())
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(p.Put).ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(fus.PutCount).To(Equal(int32(0)))
+		})
+
+		It("lists directories in different formats", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			fus.Objects["test_bucket"] = []string{"10", "dir/20", "other/5"}
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			req, err := http.NewRequest("GET", "/test_bucket/", nil)
+			Expect(err).To(BeNil())
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Header().Get("Content-type")).To(Equal("text/plain"))
+			Expect(rr.Body.String()).To(Equal("10\ndir/\nother/\n"))
+
+			req.Header.Set("Accept", "application/json")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+
+			var entries []source.DirEntry
+			Expect(json.Unmarshal(rr.Body.Bytes(), &entries)).To(Succeed())
+			Expect(entries).To(HaveLen(3))
+			Expect(entries[0].Name).To(Equal("10"))
+			Expect(entries[0].Size).To(Equal(int64(20)))
+			Expect(entries[0].ETag).ToNot(BeEmpty())
+			Expect(entries[0].IsPrefix).To(BeFalse())
+			Expect(entries[1].Name).To(Equal("dir/"))
+			Expect(entries[1].IsPrefix).To(BeTrue())
+
+			req, err = http.NewRequest("GET", "/test_bucket/?format=html", nil)
+			Expect(err).To(BeNil())
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(ContainSubstring(`<a href="/test_bucket/dir/">dir/</a>`))
+		})
+
+		It("follows all pages of large listings", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			for i := 0; i < 2500; i++ {
+				fus.Objects["test_bucket"] = append(fus.Objects["test_bucket"], fmt.Sprintf("many/file-%04d", i))
+			}
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			handler := http.HandlerFunc(p.Handler)
+			req, err := http.NewRequest("GET", "/test_bucket/many/?format=json", nil)
+			Expect(err).To(BeNil())
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+
+			var entries []source.DirEntry
+			Expect(json.Unmarshal(rr.Body.Bytes(), &entries)).To(Succeed())
+			Expect(entries).To(HaveLen(2500))
+			Expect(fus.ListCount).To(Equal(int32(3)))
+		})
+
+		It("marks stale responses", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 0)
+			p := proxy.NewS3Proxy(cache)
+			handler := http.HandlerFunc(p.Handler)
+
+			req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+			Expect(err).To(BeNil())
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Header().Get("X-Cache")).To(Equal(""))
+
+			fus.SetUnavailable(true)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Header().Get("X-Cache")).To(Equal("STALE"))
+			Expect(rr.Header().Get("Warning")).To(HavePrefix("110"))
+			Expect(rr.Body.String()).To(Equal("0 1 2 3 4 5 6 7 8 9 "))
+		})
+
+		It("times out uncached requests when offline", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			cache.SetOffline(true)
+			p := proxy.NewS3Proxy(cache)
+
+			req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+			Expect(err).To(BeNil())
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(p.Handler).ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusGatewayTimeout))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+		})
+
+		It("honours the request's cache directives", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			get := func(header string, value string) int {
+				req, err := http.NewRequest("GET", "/test_bucket/10", nil)
+				Expect(err).To(BeNil())
+				req.Header.Set(header, value)
+				rr := httptest.NewRecorder()
+				http.HandlerFunc(p.Handler).ServeHTTP(rr, req)
+				return rr.Code
+			}
+
+			Expect(get("Cache-Control", "only-if-cached")).To(Equal(http.StatusGatewayTimeout))
+			Expect(fus.GetCount).To(Equal(int32(0)))
+
+			Expect(get("Cache-Control", "")).To(Equal(http.StatusOK))
+			Expect(get("Cache-Control", "only-if-cached")).To(Equal(http.StatusOK))
+			Expect(fus.GetMetaCount).To(Equal(int32(0)))
+
+			Expect(get("Cache-Control", "no-cache")).To(Equal(http.StatusOK))
+			Expect(get("Pragma", "no-cache")).To(Equal(http.StatusOK))
+			Expect(fus.GetMetaCount).To(Equal(int32(2)))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+		})
+
+		It("passes on the headers set on objects", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			fus.Headers["/test_bucket/10"] = source.ObjectHeaders{
+				ContentEncoding: "gzip",
+				ContentDisposition: "attachment; filename=\"10.gz\"",
+				ContentLanguage: "en",
+				StorageClass: "STANDARD_IA",
+				VersionId: "v1",
+				UserMeta: map[string]string{"Build-Id": "42"},
+			}
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			for _, method := range []string{"GET", "HEAD"} {
+				req, err := http.NewRequest(method, "/test_bucket/10", nil)
+				Expect(err).To(BeNil())
+				rr := httptest.NewRecorder()
+				if method == "GET" {
+					http.HandlerFunc(p.Handler).ServeHTTP(rr, req)
+				} else {
+					http.HandlerFunc(p.Head).ServeHTTP(rr, req)
+				}
+
+				Expect(rr.Code).To(Equal(http.StatusOK))
+				Expect(rr.Header().Get("Content-Encoding")).To(Equal("gzip"))
+				Expect(rr.Header().Get("Content-Disposition")).To(Equal("attachment; filename=\"10.gz\""))
+				Expect(rr.Header().Get("Content-Language")).To(Equal("en"))
+				Expect(rr.Header().Get("x-amz-storage-class")).To(Equal("STANDARD_IA"))
+				Expect(rr.Header().Get("x-amz-version-id")).To(Equal("v1"))
+				Expect(rr.Header().Get("x-amz-meta-build-id")).To(Equal("42"))
+			}
+		})
+
+		It("remembers missing objects until they are deleted", func() {
+			cacheDir, err := ioutil.TempDir("", "cached-")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(cacheDir)
+
+			bc := ccache.Layered(ccache.Configure())
+			fus := fakes.NewFakeUpstreamSource(cacheDir, bc)
+			cache := blob_cache.NewS3Cache(bc, fus, cacheDir, 60)
+			p := proxy.NewS3Proxy(cache)
+
+			get := func() int {
+				req, err := http.NewRequest("GET", "/missing/10", nil)
+				Expect(err).To(BeNil())
+				rr := httptest.NewRecorder()
+				http.HandlerFunc(p.Handler).ServeHTTP(rr, req)
+				return rr.Code
+			}
+
+			Expect(get()).To(Equal(http.StatusNotFound))
+			Expect(get()).To(Equal(http.StatusNotFound))
+			Expect(fus.GetCount).To(Equal(int32(1)))
+
+			req, err := http.NewRequest("DELETE", "/admin/missing/10", nil)
+			Expect(err).To(BeNil())
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(p.Delete).ServeHTTP(rr, req)
+			Expect(rr.Code).To(Equal(http.StatusNoContent))
+
+			Expect(get()).To(Equal(http.StatusNotFound))
+			Expect(fus.GetCount).To(Equal(int32(2)))
+		})
+
 		It("recovers meta files", func() {
 			cacheDir, err := ioutil.TempDir("", "cached-")
 			Expect(err).To(BeNil())
@@ -182,6 +698,7 @@ var _ = Describe("S3Proxy test suite", func() {
 
 			// Create a new cache but pass in a nil source.
 			// This would cause a panic if the caching doesn't actually work.
+			cache.Close()
 			bc2 := ccache.Layered(ccache.Configure())
 			cache2 := blob_cache.NewS3Cache(bc2, nil, cacheDir, 60)
 			cache2.RecoverMeta()
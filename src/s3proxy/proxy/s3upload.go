@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"s3proxy/context"
+	"s3proxy/source"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int64  `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+
+		// The checksums of the part, e.g. ChecksumCRC32
+		Elements []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (this *S3Api) createMultipartUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, bucket, key string) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+
+	uploadId, err := this.proxy.cache.CreateMultipartUpload(ctx, "/" + bucket + "/" + key, requestMeta(req), uploadOptions(req))
+	if err != nil {
+		writeS3Error(w, req, counter, err)
+		return
+	}
+
+	writeXml(w, http.StatusOK, &initiateMultipartUploadResult{
+		Xmlns: s3Namespace,
+		Bucket: bucket,
+		Key: key,
+		UploadId: uploadId,
+	})
+}
+
+func (this *S3Api) uploadPart(ctx context.Context, w http.ResponseWriter, req *http.Request, bucket, key string) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+
+	partNumber, err := strconv.ParseInt(req.URL.Query().Get("partNumber"), 10, 64)
+	if err != nil || partNumber < 1 {
+		writeS3ErrorCode(w, req, counter, http.StatusBadRequest, "InvalidArgument",
+			"Part number must be an integer between 1 and 10000, inclusive")
+		return
+	}
+
+	uploadId := req.URL.Query().Get("uploadId")
+	opts := uploadOptions(req)
+	etag, err := this.proxy.cache.UploadPart(ctx, "/" + bucket + "/" + key, uploadId, partNumber, uploadBody(req, opts), opts)
+	if err != nil {
+		writeS3Error(w, req, counter, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (this *S3Api) completeMultipartUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, bucket, key string) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+
+	upload := &completeMultipartUpload{}
+	if err := xml.NewDecoder(req.Body).Decode(upload); err != nil {
+		writeS3ErrorCode(w, req, counter, http.StatusBadRequest, "MalformedXML",
+			"The XML you provided was not well-formed or did not validate against our published schema.")
+		return
+	}
+
+	var parts []source.CompletedPart
+	for _, part := range upload.Parts {
+		completed := source.CompletedPart{PartNumber: part.PartNumber, ETag: part.ETag}
+		for _, element := range part.Elements {
+			if strings.HasPrefix(element.XMLName.Local, "Checksum") {
+				if completed.Checksums == nil {
+					completed.Checksums = make(map[string]string)
+				}
+				completed.Checksums[element.XMLName.Local] = element.Value
+			}
+		}
+		parts = append(parts, completed)
+	}
+
+	uploadId := req.URL.Query().Get("uploadId")
+	meta, err := this.proxy.cache.CompleteMultipartUpload(ctx, "/" + bucket + "/" + key, uploadId, parts, uploadOptions(req))
+	if err != nil {
+		writeS3Error(w, req, counter, err)
+		return
+	}
+
+	if meta.VersionId != "" {
+		w.Header().Set("x-amz-version-id", meta.VersionId)
+	}
+	writeXml(w, http.StatusOK, &completeMultipartUploadResult{
+		Xmlns: s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket: bucket,
+		Key: key,
+		ETag: meta.ETag,
+	})
+}
+
+func (this *S3Api) abortMultipartUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, bucket, key string) {
+	counter := ctx.Value(0).(*cache_context.Context).Sequence
+
+	err := this.proxy.cache.AbortMultipartUpload(ctx, "/" + bucket + "/" + key, req.URL.Query().Get("uploadId"))
+	if err != nil {
+		writeS3Error(w, req, counter, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hasParam reports whether a query parameter is present, even without a value.
+func hasParam(req *http.Request, name string) bool {
+	_, ok := req.URL.Query()[name]
+	return ok
+}
+
+// SDKs may frame uploads in aws-chunked encoding, to sign each chunk. Only the
+// content itself is passed on, and checksums sent as trailers are added to
+// opts once the body has been read.
+func uploadBody(req *http.Request, opts *source.UploadOptions) io.Reader {
+	if !strings.Contains(req.Header.Get("Content-Encoding"), "aws-chunked") {
+		return req.Body
+	}
+	return &awsChunkedReader{r: bufio.NewReader(req.Body), opts: opts}
+}
+
+// contentEncoding is the Content-Encoding of an upload, as it is stored.
+func contentEncoding(req *http.Request) string {
+	var encodings []string
+	for _, e := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+		if e = strings.TrimSpace(e); e != "" && e != "aws-chunked" {
+			encodings = append(encodings, e)
+		}
+	}
+	return strings.Join(encodings, ",")
+}
+
+var errChunkedEncoding = errors.New("malformed aws-chunked encoding")
+
+// awsChunkedReader decodes an aws-chunked body. Chunk signatures are ignored,
+// trailing checksums are kept in opts.
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	opts      *source.UploadOptions
+	remaining int64
+	done      bool
+}
+
+func (this *awsChunkedReader) Read(p []byte) (int, error) {
+	if this.done {
+		return 0, io.EOF
+	}
+
+	if this.remaining == 0 {
+		line, err := this.r.ReadString('\n')
+		if err != nil {
+			return 0, errChunkedEncoding
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(strings.SplitN(line, ";", 2)[0]), 16, 64)
+		if err != nil || size < 0 {
+			return 0, errChunkedEncoding
+		}
+		if size == 0 {
+			this.done = true
+			return 0, this.readTrailers()
+		}
+		this.remaining = size
+	}
+
+	if int64(len(p)) > this.remaining {
+		p = p[:this.remaining]
+	}
+	n, err := this.r.Read(p)
+	this.remaining -= int64(n)
+
+	// Each chunk ends with a CRLF
+	if this.remaining == 0 {
+		if _, derr := this.r.Discard(2); derr != nil {
+			return n, errChunkedEncoding
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readTrailers reads the trailers after the last chunk, up to the empty line
+// which ends them.
+func (this *awsChunkedReader) readTrailers() error {
+	for {
+		line, err := this.r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if err != nil && err != io.EOF {
+				return errChunkedEncoding
+			}
+			return io.EOF
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return errChunkedEncoding
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if strings.HasPrefix(name, "x-amz-checksum-") {
+			if this.opts.Checksums == nil {
+				this.opts.Checksums = make(map[string]string)
+			}
+			this.opts.Checksums[name] = strings.TrimSpace(parts[1])
+		}
+		if err != nil {
+			return io.EOF
+		}
+	}
+}
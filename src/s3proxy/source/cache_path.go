@@ -0,0 +1,21 @@
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+)
+
+// Cached objects live below this directory. Underscores aren't allowed in
+// bucket names, so it can't clash with the old layout of bucket directories.
+const OBJECTS_DIR = "_objects"
+
+// CachePath maps an object's uri to the file it is cached in. Keys are hashed
+// so that any legal S3 key, including ones containing '..', both 'a/b' and
+// 'a/b/c', or very long names, maps to a distinct path inside cacheDir. The key
+// itself is kept in the object's meta.
+func CachePath(cacheDir, uri string) string {
+	sum := sha256.Sum256([]byte(uri))
+	hash := hex.EncodeToString(sum[:])
+	return path.Join(cacheDir, OBJECTS_DIR, hash[:2], hash[2:4], hash)
+}
@@ -0,0 +1,79 @@
+package source
+
+import (
+	"strings"
+)
+
+// Lister is the part of an UpstreamSource needed to build directory listings.
+type Lister interface {
+	List(bucket string, opts *ListOptions) (*ObjectListing, error)
+	Buckets() ([]BucketInfo, error)
+}
+
+// ListDirectory returns the immediate children of path, which is of the form
+// /bucket/prefix/. All pages of the underlying listing are followed so that
+// large prefixes are not truncated. The root path lists the buckets.
+func ListDirectory(l Lister, path string) ([]DirEntry, error) {
+	path = strings.TrimLeft(path, "/")
+
+	if path == "" {
+		buckets, err := l.Buckets()
+		if err != nil {
+			return nil, err
+		}
+
+		var results []DirEntry
+		for _, b := range buckets {
+			results = append(results, DirEntry{
+				Name: b.Name + "/",
+				LastModified: b.CreationDate,
+				IsPrefix: true,
+			})
+		}
+		return results, nil
+	}
+
+	bucket, prefix := splitS3Uri(path)
+
+	log.Infof("Returning bucket contents of '%s' with prefix '%s'", bucket, prefix)
+
+	opts := &ListOptions{
+		Prefix: prefix,
+		Delimiter: "/",
+	}
+
+	var results []DirEntry
+	for {
+		listing, err := l.List(bucket, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range listing.Objects {
+			if obj.Key == prefix {
+				continue
+			}
+
+			results = append(results, DirEntry{
+				Name: obj.Key,
+				Size: obj.Size,
+				ETag: obj.ETag,
+				LastModified: obj.LastModified,
+			})
+		}
+
+		for _, p := range listing.CommonPrefixes {
+			results = append(results, DirEntry{
+				Name: p,
+				IsPrefix: true,
+			})
+		}
+
+		if !listing.IsTruncated || listing.NextContinuationToken == "" {
+			break
+		}
+		opts.ContinuationToken = listing.NextContinuationToken
+	}
+
+	return results, nil
+}
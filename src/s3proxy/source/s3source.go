@@ -6,17 +6,22 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"strings"
-	"path"
 	"github.com/karlseguin/ccache"
 	"github.com/op/go-logging"
-	"errors"
 	"golang.org/x/net/context"
+	"io"
+	"fmt"
+	"sort"
+	"time"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 )
 
 type S3Source struct{
 	session      *session.Session
 	blockCache   *ccache.LayeredCache
 	baseCacheDir string
+	retries      int
+	retryBackoff time.Duration
 }
 
 var log = logging.MustGetLogger("s3proxy")
@@ -31,12 +36,22 @@ func NewS3Source(cache *ccache.LayeredCache, region, cacheDir string) *S3Source
 		session: sess,
 		blockCache: cache,
 		baseCacheDir: cacheDir,
+		retries: faulting.UPSTREAM_RETRIES,
+		retryBackoff: faulting.RETRY_BACKOFF,
 	}
 }
 
+// SetRetries configures how often an interrupted download is resumed, and the
+// initial delay before doing so.
+func (this *S3Source) SetRetries(retries int, backoff time.Duration) {
+	this.retries = retries
+	this.retryBackoff = backoff
+}
+
 func (this S3Source) Get(ctx context.Context, uri string) (*faulting.FaultingFile, *Meta, error) {
 
-	bucket, object := splitS3Uri(uri)
+	objectUri, version := SplitVersion(uri)
+	bucket, object := splitS3Uri(objectUri)
 
 	svc := s3.New(this.session)
 
@@ -44,8 +59,15 @@ func (this S3Source) Get(ctx context.Context, uri string) (*faulting.FaultingFil
 		Bucket: aws.String(bucket),
 		Key:    aws.String(object),
 	}
+	if version != "" {
+		params.VersionId = aws.String(version)
+	}
 
-	getResp, err := svc.GetObject(params)
+	// The SDK doesn't know about additional checksums, so they are asked for
+	// and read directly
+	req, getResp := svc.GetObjectRequest(params)
+	req.HTTPRequest.Header.Set("x-amz-checksum-mode", "ENABLED")
+	err := req.Send()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -56,32 +78,93 @@ func (this S3Source) Get(ctx context.Context, uri string) (*faulting.FaultingFil
 	//downloader := s3manager.NewDownloader(this.session)
 	//go downloader.Download(pWriter, params)
 
-	objectFile := path.Join(this.baseCacheDir, bucket, object)
+	objectFile := CachePath(this.baseCacheDir, uri)
 	sCache := this.blockCache.GetOrCreateSecondaryCache(uri)
 	ff, err := faulting.NewFaultingFile(getResp.Body, objectFile, *getResp.ContentLength, sCache)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	ff.Fetcher = this.Fetcher(uri, *getResp.ETag)
+	ff.Retries = this.retries
+	ff.RetryBackoff = this.retryBackoff
+
+	// With SSE-KMS the ETag is not an MD5 of the content
+	if aws.StringValue(getResp.ServerSideEncryption) != "aws:kms" {
+		ff.AddVerifier(faulting.MD5Verifier(*getResp.ETag))
+	}
+	ff.AddVerifier(faulting.CRC32CVerifier(req.HTTPResponse.Header.Get("x-amz-checksum-crc32c")))
+	ff.AddVerifier(faulting.SHA256Verifier(req.HTTPResponse.Header.Get("x-amz-checksum-sha256")))
+
 	ff.Stream(nil)
 	meta := &Meta{
 		Size: *getResp.ContentLength,
 		LastModified: *getResp.LastModified,
 		ContentType: *getResp.ContentType,
 		ETag: *getResp.ETag,
+		CacheControl: aws.StringValue(getResp.CacheControl),
+		UpstreamExpires: aws.TimeValue(getResp.Expires),
+		ObjectHeaders: ObjectHeaders{
+			ContentEncoding: aws.StringValue(getResp.ContentEncoding),
+			ContentDisposition: aws.StringValue(getResp.ContentDisposition),
+			ContentLanguage: aws.StringValue(getResp.ContentLanguage),
+			StorageClass: aws.StringValue(getResp.StorageClass),
+			VersionId: aws.StringValue(getResp.VersionId),
+			UserMeta: aws.StringValueMap(getResp.Metadata),
+		},
 	}
 
 	return ff, meta, nil
 }
 
+// Fetcher returns a function which retrieves parts of an object. The ETag is
+// pinned so that a changed object is not spliced into the cached one.
+func (this S3Source) Fetcher(uri, etag string) faulting.RangeFetcher {
+	objectUri, version := SplitVersion(uri)
+	bucket, object := splitS3Uri(objectUri)
+
+	return func(start, end int64) (io.ReadCloser, error) {
+		svc := s3.New(this.session)
+
+		params := &s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(object),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end - 1)),
+			IfMatch: aws.String(etag),
+		}
+		if version != "" {
+			params.VersionId = aws.String(version)
+		}
+
+		getResp, err := svc.GetObject(params)
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "PreconditionFailed" {
+				return nil, faulting.ErrChanged
+			}
+			return nil, err
+		}
+
+		if aws.StringValue(getResp.ETag) != etag {
+			getResp.Body.Close()
+			return nil, faulting.ErrChanged
+		}
+
+		return getResp.Body, nil
+	}
+}
+
 func (this S3Source) GetMeta(uri string) (*Meta, error) {
-	bucket, object := splitS3Uri(uri)
+	objectUri, version := SplitVersion(uri)
+	bucket, object := splitS3Uri(objectUri)
 	svc := s3.New(this.session)
 
 	params := &s3.HeadObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(object),
 	}
+	if version != "" {
+		params.VersionId = aws.String(version)
+	}
 
 	headResp, err := svc.HeadObject(params)
 	if err != nil {
@@ -93,67 +176,162 @@ func (this S3Source) GetMeta(uri string) (*Meta, error) {
 		LastModified: *headResp.LastModified,
 		ContentType: *headResp.ContentType,
 		ETag: *headResp.ETag,
+		CacheControl: aws.StringValue(headResp.CacheControl),
+		UpstreamExpires: aws.TimeValue(headResp.Expires),
+		ObjectHeaders: ObjectHeaders{
+			ContentEncoding: aws.StringValue(headResp.ContentEncoding),
+			ContentDisposition: aws.StringValue(headResp.ContentDisposition),
+			ContentLanguage: aws.StringValue(headResp.ContentLanguage),
+			StorageClass: aws.StringValue(headResp.StorageClass),
+			VersionId: aws.StringValue(headResp.VersionId),
+			UserMeta: aws.StringValueMap(headResp.Metadata),
+		},
 	}, nil
 }
 
-func (this S3Source) Directory(path string) ([]string, error) {
-	var bucket string
+func (this S3Source) Directory(path string) ([]DirEntry, error) {
+	return ListDirectory(this, path)
+}
+
+func (this S3Source) List(bucket string, opts *ListOptions) (*ObjectListing, error) {
+	if opts.Versions {
+		return this.listVersions(bucket, opts)
+	}
+
 	svc := s3.New(this.session)
 
-	// Strip leading '/'s
-	for strings.Index(path, "/") == 0 {
-		path = path[1:]
+	params := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(opts.Prefix),
+	}
+	if opts.Delimiter != "" {
+		params.Delimiter = aws.String(opts.Delimiter)
+	}
+	if opts.ContinuationToken != "" {
+		params.ContinuationToken = aws.String(opts.ContinuationToken)
+	}
+	if opts.StartAfter != "" {
+		params.StartAfter = aws.String(opts.StartAfter)
+	}
+	if opts.MaxKeys > 0 {
+		params.MaxKeys = aws.Int64(opts.MaxKeys)
 	}
 
-	slashIdx := strings.Index(path, "/")
-	if slashIdx > 0 {
-		bucket = path[:slashIdx]
-	} else {
-		return nil, errors.New("Cannot list all buckets currently")
+	resp, err := svc.ListObjectsV2(params)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &ObjectListing{
+		IsTruncated: aws.BoolValue(resp.IsTruncated),
+		NextContinuationToken: aws.StringValue(resp.NextContinuationToken),
+	}
+
+	for _, obj := range resp.Contents {
+		listing.Objects = append(listing.Objects, ObjectInfo{
+			Key: aws.StringValue(obj.Key),
+			Size: aws.Int64Value(obj.Size),
+			ETag: aws.StringValue(obj.ETag),
+			LastModified: aws.TimeValue(obj.LastModified),
+			StorageClass: aws.StringValue(obj.StorageClass),
+		})
+	}
+
+	for _, p := range resp.CommonPrefixes {
+		listing.CommonPrefixes = append(listing.CommonPrefixes, aws.StringValue(p.Prefix))
 	}
 
-	prefix := path[slashIdx + 1:]
+	return listing, nil
+}
 
-	log.Infof("Returning bucket contents of '%s' with prefix '%s'", bucket, prefix)
+// listVersions lists every version of the objects, including delete markers.
+// Versions of a key are listed newest first.
+func (this S3Source) listVersions(bucket string, opts *ListOptions) (*ObjectListing, error) {
+	svc := s3.New(this.session)
 
-	params := &s3.ListObjectsInput{
+	params := &s3.ListObjectVersionsInput{
 		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
+		Prefix: aws.String(opts.Prefix),
+	}
+	if opts.Delimiter != "" {
+		params.Delimiter = aws.String(opts.Delimiter)
+	}
+	if opts.StartAfter != "" {
+		params.KeyMarker = aws.String(opts.StartAfter)
+	}
+	if opts.VersionIdMarker != "" {
+		params.VersionIdMarker = aws.String(opts.VersionIdMarker)
+	}
+	if opts.MaxKeys > 0 {
+		params.MaxKeys = aws.Int64(opts.MaxKeys)
 	}
 
-	resp, err := svc.ListObjects(params)
+	resp, err := svc.ListObjectVersions(params)
 	if err != nil {
 		return nil, err
 	}
 
-	var results []string
-	subdirs := make(map[string]bool)
-	for _, keyObj := range resp.Contents {
-		key := *keyObj.Key
+	listing := &ObjectListing{
+		IsTruncated: aws.BoolValue(resp.IsTruncated),
+		NextKeyMarker: aws.StringValue(resp.NextKeyMarker),
+		NextVersionIdMarker: aws.StringValue(resp.NextVersionIdMarker),
+	}
 
-		if key == prefix {
-			continue
-		}
+	for _, v := range resp.Versions {
+		listing.Objects = append(listing.Objects, ObjectInfo{
+			Key: aws.StringValue(v.Key),
+			Size: aws.Int64Value(v.Size),
+			ETag: aws.StringValue(v.ETag),
+			LastModified: aws.TimeValue(v.LastModified),
+			StorageClass: aws.StringValue(v.StorageClass),
+			VersionId: aws.StringValue(v.VersionId),
+			IsLatest: aws.BoolValue(v.IsLatest),
+		})
+	}
 
-		sIdx := strings.Index(key[len(prefix):], "/")
-		if sIdx != -1 {
-			subdir := key[:(len(prefix) + sIdx + 1)]
-			subdirs[subdir] = true
-			continue
+	for _, m := range resp.DeleteMarkers {
+		listing.Objects = append(listing.Objects, ObjectInfo{
+			Key: aws.StringValue(m.Key),
+			LastModified: aws.TimeValue(m.LastModified),
+			VersionId: aws.StringValue(m.VersionId),
+			IsLatest: aws.BoolValue(m.IsLatest),
+			DeleteMarker: true,
+		})
+	}
+
+	// S3 returns versions and delete markers separately
+	sort.SliceStable(listing.Objects, func(i, j int) bool {
+		a, b := listing.Objects[i], listing.Objects[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
 		}
+		return a.LastModified.After(b.LastModified)
+	})
 
-		results = append(results, key)
+	for _, p := range resp.CommonPrefixes {
+		listing.CommonPrefixes = append(listing.CommonPrefixes, aws.StringValue(p.Prefix))
 	}
 
-	for k, _ := range subdirs {
-		results = append(results, k)
+	return listing, nil
+}
+
+func (this S3Source) Buckets() ([]BucketInfo, error) {
+	svc := s3.New(this.session)
+
+	resp, err := svc.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		return nil, err
 	}
 
-	for _, k := range results {
-		log.Infof("  -> %s", k)
+	var buckets []BucketInfo
+	for _, b := range resp.Buckets {
+		buckets = append(buckets, BucketInfo{
+			Name: aws.StringValue(b.Name),
+			CreationDate: aws.TimeValue(b.CreationDate),
+		})
 	}
 
-	return results, nil
+	return buckets, nil
 }
 
 func splitS3Uri(uri string) (string, string) {
@@ -165,7 +343,7 @@ func splitS3Uri(uri string) (string, string) {
 	}
 
 	if idx + 1 == len(uri) {
-		return uri, ""
+		return uri[:idx], ""
 	}
 
 	return uri[:idx], uri[idx+1:]
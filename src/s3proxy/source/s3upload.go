@@ -0,0 +1,210 @@
+package source
+
+import (
+	"encoding/xml"
+	"io"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Put writes an object to S3. The meta returned is what was asked for, with
+// the ETag and version S3 gave the object.
+func (this S3Source) Put(uri string, body io.ReadSeeker, meta *Meta, opts *UploadOptions) (*Meta, error) {
+	bucket, object := splitS3Uri(uri)
+	svc := s3.New(this.session)
+
+	params := &s3.PutObjectInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(object),
+		Body:               body,
+		ContentLength:      aws.Int64(meta.Size),
+		ContentType:        optionalString(meta.ContentType),
+		CacheControl:       optionalString(meta.CacheControl),
+		ContentEncoding:    optionalString(meta.ContentEncoding),
+		ContentDisposition: optionalString(meta.ContentDisposition),
+		ContentLanguage:    optionalString(meta.ContentLanguage),
+		StorageClass:       optionalString(meta.StorageClass),
+		Metadata:           aws.StringMap(meta.UserMeta),
+		ACL:                  optionalString(opts.ACL),
+		ServerSideEncryption: optionalString(opts.ServerSideEncryption),
+		SSEKMSKeyId:          optionalString(opts.SSEKMSKeyId),
+		Tagging:              optionalString(opts.Tagging),
+		ContentMD5:           optionalString(opts.ContentMD5),
+	}
+	if !meta.UpstreamExpires.IsZero() {
+		params.Expires = aws.Time(meta.UpstreamExpires)
+	}
+
+	req, resp := svc.PutObjectRequest(params)
+	setChecksumHeaders(req, opts)
+	err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := *meta
+	stored.ETag = aws.StringValue(resp.ETag)
+	stored.VersionId = aws.StringValue(resp.VersionId)
+	return &stored, nil
+}
+
+func (this S3Source) CreateMultipartUpload(uri string, meta *Meta, opts *UploadOptions) (string, error) {
+	bucket, object := splitS3Uri(uri)
+	svc := s3.New(this.session)
+
+	params := &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(object),
+		ContentType:        optionalString(meta.ContentType),
+		CacheControl:       optionalString(meta.CacheControl),
+		ContentEncoding:    optionalString(meta.ContentEncoding),
+		ContentDisposition: optionalString(meta.ContentDisposition),
+		ContentLanguage:    optionalString(meta.ContentLanguage),
+		StorageClass:       optionalString(meta.StorageClass),
+		Metadata:           aws.StringMap(meta.UserMeta),
+		ACL:                  optionalString(opts.ACL),
+		ServerSideEncryption: optionalString(opts.ServerSideEncryption),
+		SSEKMSKeyId:          optionalString(opts.SSEKMSKeyId),
+	}
+	if !meta.UpstreamExpires.IsZero() {
+		params.Expires = aws.Time(meta.UpstreamExpires)
+	}
+
+	// The SDK doesn't know about tags on multipart uploads either
+	req, resp := svc.CreateMultipartUploadRequest(params)
+	if opts.Tagging != "" {
+		req.HTTPRequest.Header.Set("X-Amz-Tagging", opts.Tagging)
+	}
+	setChecksumHeaders(req, opts)
+	err := req.Send()
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.UploadId), nil
+}
+
+func (this S3Source) UploadPart(uri, uploadId string, partNumber int64, body io.ReadSeeker, opts *UploadOptions) (string, error) {
+	bucket, object := splitS3Uri(uri)
+	svc := s3.New(this.session)
+
+	req, resp := svc.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(object),
+		UploadId:   aws.String(uploadId),
+		PartNumber: aws.Int64(partNumber),
+		Body:       body,
+		ContentMD5: optionalString(opts.ContentMD5),
+	})
+	setChecksumHeaders(req, opts)
+	err := req.Send()
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.ETag), nil
+}
+
+// CompleteMultipartUpload returns the ETag and version of the object, which is
+// all the response tells.
+func (this S3Source) CompleteMultipartUpload(uri, uploadId string, parts []CompletedPart, opts *UploadOptions) (*Meta, error) {
+	bucket, object := splitS3Uri(uri)
+	svc := s3.New(this.session)
+
+	upload := &s3.CompletedMultipartUpload{}
+	for _, part := range parts {
+		upload.Parts = append(upload.Parts, &s3.CompletedPart{
+			PartNumber: aws.Int64(part.PartNumber),
+			ETag:       aws.String(part.ETag),
+		})
+	}
+
+	req, resp := svc.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(object),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: upload,
+	})
+	setChecksumHeaders(req, opts)
+	if completedChecksums(parts) {
+		body, err := completeUploadBody(parts)
+		if err != nil {
+			return nil, err
+		}
+		req.Handlers.Build.PushBack(func(r *request.Request) { r.SetBufferBody(body) })
+	}
+	err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &Meta{ETag: aws.StringValue(resp.ETag)}
+	stored.VersionId = aws.StringValue(resp.VersionId)
+	return stored, nil
+}
+
+func (this S3Source) AbortMultipartUpload(uri, uploadId string) error {
+	bucket, object := splitS3Uri(uri)
+	svc := s3.New(this.session)
+
+	_, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(object),
+		UploadId: aws.String(uploadId),
+	})
+	return err
+}
+
+// The SDK doesn't know about additional checksums, so they are passed on as
+// they were sent.
+func setChecksumHeaders(req *request.Request, opts *UploadOptions) {
+	for name, value := range opts.Checksums {
+		req.HTTPRequest.Header.Set(name, value)
+	}
+}
+
+func completedChecksums(parts []CompletedPart) bool {
+	for _, part := range parts {
+		if len(part.Checksums) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type completedPartXml struct {
+	PartNumber int64         `xml:"PartNumber"`
+	ETag       string        `xml:"ETag"`
+	Checksums  []checksumXml
+}
+
+type checksumXml struct {
+	XMLName xml.Name
+	Value   string   `xml:",chardata"`
+}
+
+// completeUploadBody writes the body of a CompleteMultipartUpload request
+// which includes the checksums of the parts, which the SDK can't.
+func completeUploadBody(parts []CompletedPart) ([]byte, error) {
+	upload := struct {
+		XMLName xml.Name           `xml:"CompleteMultipartUpload"`
+		Xmlns   string             `xml:"xmlns,attr"`
+		Parts   []completedPartXml `xml:"Part"`
+	}{Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/"}
+
+	for _, part := range parts {
+		p := completedPartXml{PartNumber: part.PartNumber, ETag: part.ETag}
+		for name, value := range part.Checksums {
+			p.Checksums = append(p.Checksums, checksumXml{XMLName: xml.Name{Local: name}, Value: value})
+		}
+		upload.Parts = append(upload.Parts, p)
+	}
+	return xml.Marshal(&upload)
+}
+
+// optionalString leaves out empty parameters.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
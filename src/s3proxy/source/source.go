@@ -1,21 +1,151 @@
 package source
 
 import (
+	"io"
 	"time"
 	"s3proxy/faulting"
 	"golang.org/x/net/context"
 )
 
 type Meta struct {
+	Key          string     `json:"key"`
 	Expires      time.Time  `json:"expires"`
 	LastModified time.Time  `json:"last_modified"`
 	Size         int64      `json:"size"`
 	ContentType  string     `json:"content_type"`
 	ETag         string     `json:"etag"`
+
+	// The Cache-Control and Expires set on the object in S3
+	CacheControl    string    `json:"cache_control,omitempty"`
+	UpstreamExpires time.Time `json:"upstream_expires,omitempty"`
+
+	// When the object was last fetched or revalidated
+	Validated    time.Time       `json:"validated"`
+
+	ObjectHeaders
+
+	// Download progress, so that a partial object is never mistaken for a
+	// complete one after a restart
+	Complete     bool            `json:"complete"`
+	BlockSize    int             `json:"block_size,omitempty"`
+	Blocks       faulting.Bitmap `json:"blocks,omitempty"`
+	BlockSums    []uint32        `json:"block_sums,omitempty"`
+
+	// When the object was last read, so that eviction survives a restart
+	LastAccess   time.Time       `json:"last_access"`
+
+	// Whether the content matched the checksums advertised by the upstream
+	Verified     bool            `json:"verified"`
+}
+
+// ObjectHeaders are set on an object in S3 and passed on to clients as they
+// are.
+type ObjectHeaders struct {
+	ContentEncoding    string            `json:"content_encoding,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	ContentLanguage    string            `json:"content_language,omitempty"`
+	StorageClass       string            `json:"storage_class,omitempty"`
+	VersionId          string            `json:"version_id,omitempty"`
+
+	// x-amz-meta-* headers, without the prefix
+	UserMeta           map[string]string `json:"user_meta,omitempty"`
+}
+
+// ObjectInfo describes a single object in a listing.
+type ObjectInfo struct {
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	ETag         string     `json:"etag"`
+	LastModified time.Time  `json:"last_modified"`
+	StorageClass string     `json:"storage_class"`
+
+	// Only set when listing versions
+	VersionId    string     `json:"version_id,omitempty"`
+	IsLatest     bool       `json:"is_latest,omitempty"`
+	DeleteMarker bool       `json:"delete_marker,omitempty"`
+}
+
+// ListOptions mirror the parameters of S3's ListObjectsV2.
+type ListOptions struct {
+	Prefix            string
+	Delimiter         string
+	ContinuationToken string
+	StartAfter        string
+	MaxKeys           int64
+
+	// List every version of the objects instead, as ListObjectVersions does.
+	// StartAfter is then the key marker.
+	Versions          bool
+	VersionIdMarker   string
+}
+
+// ObjectListing is a single page of a bucket listing.
+type ObjectListing struct {
+	Objects               []ObjectInfo
+	CommonPrefixes        []string
+	IsTruncated           bool
+	NextContinuationToken string
+
+	// Where the next page of a listing of versions starts
+	NextKeyMarker         string
+	NextVersionIdMarker   string
+}
+
+// DirEntry is a single entry in a directory listing. Prefixes, which act
+// like sub-directories, have a Name ending in '/'.
+type DirEntry struct {
+	Name         string     `json:"name"`
+	Size         int64      `json:"size"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified time.Time  `json:"last_modified,omitempty"`
+	IsPrefix     bool       `json:"is_prefix"`
+}
+
+// UploadOptions are the headers of an upload which S3 acts on but which
+// aren't kept with the object's meta.
+type UploadOptions struct {
+	ACL                  string
+	ServerSideEncryption string
+	SSEKMSKeyId          string
+	Tagging              string
+	ContentMD5           string
+
+	// x-amz-checksum-* headers, including those sent as aws-chunked
+	// trailers, as they are passed on
+	Checksums            map[string]string
+}
+
+// CompletedPart is a part of a multipart upload, as given when completing it.
+type CompletedPart struct {
+	PartNumber int64
+	ETag       string
+
+	// Checksums of the part, by element name (e.g. ChecksumCRC32)
+	Checksums  map[string]string
+}
+
+type BucketInfo struct {
+	Name         string
+	CreationDate time.Time
 }
 
 type UpstreamSource interface {
 	Get(ctx context.Context, uri string) (*faulting.FaultingFile, *Meta, error)
 	GetMeta(uri string) (*Meta, error)
-	Directory(path string) ([]string, error)
+	// Fetcher retrieves parts of an object, as long as it still has the
+	// given ETag
+	Fetcher(uri, etag string) faulting.RangeFetcher
+	Directory(path string) ([]DirEntry, error)
+	List(bucket string, opts *ListOptions) (*ObjectListing, error)
+	Buckets() ([]BucketInfo, error)
+
+	// Put writes an object, returning as much of its meta as the upstream
+	// answers with. Anything else has to be read back with GetMeta.
+	Put(uri string, body io.ReadSeeker, meta *Meta, opts *UploadOptions) (*Meta, error)
+
+	// Multipart uploads are passed on part by part
+	CreateMultipartUpload(uri string, meta *Meta, opts *UploadOptions) (string, error)
+	UploadPart(uri, uploadId string, partNumber int64, body io.ReadSeeker, opts *UploadOptions) (string, error)
+	CompleteMultipartUpload(uri, uploadId string, parts []CompletedPart, opts *UploadOptions) (*Meta, error)
+	AbortMultipartUpload(uri, uploadId string) error
 }
@@ -0,0 +1,27 @@
+package source
+
+import (
+	"strings"
+)
+
+// A version of an object is cached under the object's uri with the version
+// appended after a NUL, which can't occur in an S3 key, so that keys which
+// look like versioned requests are never mistaken for them.
+const VERSION_SEPARATOR = "\x00"
+
+// VersionedUri returns the uri of a version of an object. Without a version
+// it is the object's uri.
+func VersionedUri(uri, versionId string) string {
+	if versionId == "" {
+		return uri
+	}
+	return uri + VERSION_SEPARATOR + versionId
+}
+
+// SplitVersion splits a uri into the object's uri and the version, if any.
+func SplitVersion(uri string) (string, string) {
+	if idx := strings.Index(uri, VERSION_SEPARATOR); idx >= 0 {
+		return uri[:idx], uri[idx + len(VERSION_SEPARATOR):]
+	}
+	return uri, ""
+}